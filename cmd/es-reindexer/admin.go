@@ -0,0 +1,325 @@
+// Copyright 2016-present InterPals. All Rights Reserved.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/olivere/elastic"
+	"github.com/sirupsen/logrus"
+)
+
+// Blocks fetch goroutines at page boundaries while it's paused
+type pauseGate struct {
+	mutex  sync.Mutex
+	paused bool
+
+	// Closed on resume
+	resumed chan struct{}
+}
+
+func newPauseGate() *pauseGate {
+	return &pauseGate{
+		resumed: make(chan struct{}),
+	}
+}
+
+func (this *pauseGate) Pause() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if !this.paused {
+		this.paused = true
+		this.resumed = make(chan struct{})
+	}
+}
+
+func (this *pauseGate) Resume() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.paused {
+		this.paused = false
+		close(this.resumed)
+	}
+}
+
+func (this *pauseGate) Paused() bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	return this.paused
+}
+
+// Returns when fetch isn't paused or ctx is cancelled
+func (this *pauseGate) Wait(ctx context.Context) {
+	this.mutex.Lock()
+	paused, resumed := this.paused, this.resumed
+	this.mutex.Unlock()
+
+	if !paused {
+		return
+	}
+
+	select {
+	case <-resumed:
+	case <-ctx.Done():
+	}
+}
+
+// Limits number of bulk workers which write at the same time, workers over the limit wait before the next bulk
+type workerGate struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	limit  int
+	active int
+}
+
+func newWorkerGate() *workerGate {
+	gate := &workerGate{}
+	gate.cond = sync.NewCond(&gate.mutex)
+
+	return gate
+}
+
+// 0 means all workers of elasticsearch.threads
+func (this *workerGate) SetLimit(limit int) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.limit = limit
+	this.cond.Broadcast()
+}
+
+func (this *workerGate) Limit() int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	return this.limit
+}
+
+func (this *workerGate) Acquire() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	for this.limit > 0 && this.active >= this.limit {
+		this.cond.Wait()
+	}
+
+	this.active++
+}
+
+func (this *workerGate) Release() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.active--
+	this.cond.Signal()
+}
+
+// Run which is shown by /status
+type activeRun struct {
+	Command string    `json:"command"`
+	Started time.Time `json:"started"`
+
+	counters    *runCounters
+	checkpoints *checkpointTracker
+	progress    *progressReporter
+}
+
+// Runs in progress by name of daemon job, or by command on command line, the daemon runs several at once
+type runRegistry struct {
+	mutex sync.Mutex
+	runs  map[string]*activeRun
+}
+
+func (this *runRegistry) Add(
+	name string,
+	command string,
+	counters *runCounters,
+	checkpoints *checkpointTracker,
+	progress *progressReporter) func() {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	run := &activeRun{
+		Command:     command,
+		Started:     time.Now(),
+		counters:    counters,
+		checkpoints: checkpoints,
+		progress:    progress,
+	}
+
+	this.runs[name] = run
+
+	return func() {
+		this.mutex.Lock()
+		defer this.mutex.Unlock()
+
+		if this.runs[name] == run {
+			delete(this.runs, name)
+		}
+	}
+}
+
+func (this *runRegistry) Status() map[string]interface{} {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	result := map[string]interface{}{}
+
+	for name, run := range this.runs {
+		status := map[string]interface{}{
+			"command":    run.Command,
+			"started":    run.Started,
+			"fetched":    run.counters.Fetched(),
+			"sent":       run.counters.Sent(),
+			"watermark":  run.checkpoints.Watermark(),
+			"partitions": run.checkpoints.Progress(),
+		}
+
+		if run.progress != nil {
+			estimates, all := run.progress.Estimates()
+			if all != nil {
+				status["estimates"] = estimates
+				status["total"] = all
+			}
+		}
+
+		result[name] = status
+	}
+
+	return result
+}
+
+// Admin API steers all runs of the process
+var (
+	fetchPause  = newPauseGate()
+	bulkWorkers = newWorkerGate()
+	activeRuns  = &runRegistry{runs: map[string]*activeRun{}}
+)
+
+// Status, pause/resume of fetch, number of bulk workers and health checks.
+// There is no authentication, address of http-listen must not be public.
+type adminApi struct {
+	ctx    context.Context
+	client *elastic.Client
+	dbs    *databases
+
+	// Only when it runs as daemon
+	daemon *daemon
+}
+
+func (this *adminApi) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/status", this.status)
+	mux.HandleFunc("/pause", this.pause)
+	mux.HandleFunc("/resume", this.resume)
+	mux.HandleFunc("/workers", this.workers)
+	mux.HandleFunc("/healthz", this.healthz)
+	mux.HandleFunc("/readyz", this.readyz)
+}
+
+func writeJson(writer http.ResponseWriter, status int, value interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+
+	err := json.NewEncoder(writer).Encode(value)
+	if err != nil {
+		logger.WithField("component", "http").WithError(err).Warn("Cannot write response")
+	}
+}
+
+// Changes must be sent by POST, so they aren't triggered by crawlers and prefetch
+func requirePost(writer http.ResponseWriter, request *http.Request) bool {
+	if request.Method != http.MethodPost {
+		writeJson(writer, http.StatusMethodNotAllowed, map[string]string{"error": "use POST"})
+		return false
+	}
+
+	return true
+}
+
+func (this *adminApi) status(writer http.ResponseWriter, request *http.Request) {
+	status := map[string]interface{}{
+		"paused":        fetchPause.Paused(),
+		"workers-limit": bulkWorkers.Limit(),
+		"fetched":       totalFetch.Value(),
+		"sent":          totalSend.Value(),
+		"runs":          activeRuns.Status(),
+	}
+
+	if this.daemon != nil {
+		status["jobs"] = this.daemon.Status()
+	}
+
+	writeJson(writer, http.StatusOK, status)
+}
+
+func (this *adminApi) pause(writer http.ResponseWriter, request *http.Request) {
+	if !requirePost(writer, request) {
+		return
+	}
+
+	fetchPause.Pause()
+	logger.WithField("component", "http").Info("Fetch is paused")
+
+	writeJson(writer, http.StatusOK, map[string]bool{"paused": true})
+}
+
+func (this *adminApi) resume(writer http.ResponseWriter, request *http.Request) {
+	if !requirePost(writer, request) {
+		return
+	}
+
+	fetchPause.Resume()
+	logger.WithField("component", "http").Info("Fetch is resumed")
+
+	writeJson(writer, http.StatusOK, map[string]bool{"paused": false})
+}
+
+// GET returns the limit, POST with "limit" parameter changes it, 0 removes the limit
+func (this *adminApi) workers(writer http.ResponseWriter, request *http.Request) {
+	if request.Method == http.MethodPost {
+		limit, err := strconv.ParseUint(request.FormValue("limit"), 10, 8)
+		if err != nil {
+			writeJson(writer, http.StatusBadRequest, map[string]string{"error": "limit must be a number from 0 to 255"})
+			return
+		}
+
+		bulkWorkers.SetLimit(int(limit))
+		logger.WithFields(logrus.Fields{"component": "http", "limit": limit}).Info("Bulk workers limit is changed")
+	}
+
+	writeJson(writer, http.StatusOK, map[string]int{"limit": bulkWorkers.Limit()})
+}
+
+// Process is alive
+func (this *adminApi) healthz(writer http.ResponseWriter, request *http.Request) {
+	writeJson(writer, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// Process isn't shutting down and its connections are alive
+func (this *adminApi) readyz(writer http.ResponseWriter, request *http.Request) {
+	var problem string
+
+	if this.ctx.Err() != nil {
+		problem = "shutting down"
+	} else if this.client != nil && !this.client.IsRunning() {
+		problem = "elasticsearch client isn't running"
+	} else if err := this.dbs.Ping(); err != nil {
+		problem = "database: " + err.Error()
+	}
+
+	if problem != "" {
+		writeJson(writer, http.StatusServiceUnavailable, map[string]string{"status": problem})
+		return
+	}
+
+	writeJson(writer, http.StatusOK, map[string]string{"status": "ok"})
+}
@@ -0,0 +1,153 @@
+// Copyright 2016-present InterPals. All Rights Reserved.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	esreindexer "github.com/interpals/es-reindexer"
+	"github.com/olivere/elastic"
+	"github.com/sirupsen/logrus"
+)
+
+// Full rebuild indexes into a new generation "<alias>_<timestamp>" and moves the alias to it after success,
+// so searches are served by the previous generation until the new one is complete
+const indexGenerationLayout = "20060102150405"
+
+func newIndexGenerationName(alias string) string {
+	return alias + "_" + time.Now().Format(indexGenerationLayout)
+}
+
+func indexGenerationPattern(alias string) *regexp.Regexp {
+	return regexp.MustCompile("^" + regexp.QuoteMeta(alias) + `_\d{14}$`)
+}
+
+func createIndexGeneration(
+	ctx context.Context,
+	client *elastic.Client,
+	alias string,
+	configuration esreindexer.ElasticSearchConfig,
+	format documentFormat) (string, error) {
+
+	index := newIndexGenerationName(alias)
+
+	err := createIndex(ctx, client, alias, index, configuration, format)
+	if err != nil {
+		return "", err
+	}
+
+	loggerFromContext(ctx).WithFields(logrus.Fields{"component": "es", "index": index, "alias": alias}).Info("Created index generation")
+
+	return index, nil
+}
+
+// Indices which alias points to
+func aliasIndices(ctx context.Context, client *elastic.Client, alias string) ([]string, error) {
+	aliases, err := client.Aliases().Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return aliases.IndicesByAlias(alias), nil
+}
+
+// Atomically points alias to index only, it must not be a regular index
+func swapAlias(ctx context.Context, client *elastic.Client, alias string, index string) error {
+	current, err := aliasIndices(ctx, client, alias)
+	if err != nil {
+		return err
+	}
+
+	if len(current) == 0 {
+		exists, err := client.IndexExists(alias).Do(ctx)
+		if err != nil {
+			return err
+		}
+
+		if exists {
+			return fmt.Errorf(
+				"%s is an index, not an alias; new generation %s is kept, delete %s and add alias to %s manually",
+				alias,
+				index,
+				alias,
+				index,
+			)
+		}
+	}
+
+	service := client.Alias().Add(index, alias)
+	for _, old := range current {
+		if old != index {
+			service.Remove(old, alias)
+		}
+	}
+
+	_, err = service.Do(ctx)
+	if err != nil {
+		return err
+	}
+
+	loggerFromContext(ctx).WithFields(logrus.Fields{"component": "es", "alias": alias, "from": current, "index": index}).Info("Alias is moved")
+
+	return nil
+}
+
+// Deletes old generations of the alias keeping the newest retention ones besides the current
+func removeOldIndexGenerations(
+	ctx context.Context,
+	client *elastic.Client,
+	alias string,
+	current string,
+	retention int) error {
+
+	names, err := client.IndexNames()
+	if err != nil {
+		return err
+	}
+
+	aliased, err := aliasIndices(ctx, client, alias)
+	if err != nil {
+		return err
+	}
+
+	pattern := indexGenerationPattern(alias)
+
+	var generations []string
+	for _, name := range names {
+		if name != current && pattern.MatchString(name) && !containsString(aliased, name) {
+			generations = append(generations, name)
+		}
+	}
+
+	// Timestamp layout is sortable, the newest are in the end
+	sort.Strings(generations)
+
+	if len(generations) <= retention {
+		return nil
+	}
+
+	obsolete := generations[:len(generations)-retention]
+
+	_, err = client.DeleteIndex(obsolete...).Do(ctx)
+	if err != nil {
+		return err
+	}
+
+	loggerFromContext(ctx).WithFields(logrus.Fields{"component": "es", "alias": alias, "indices": obsolete}).Info("Deleted old generations")
+
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,332 @@
+// Copyright 2016-present InterPals. All Rights Reserved.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	mysqldriver "github.com/go-sql-driver/mysql"
+	esreindexer "github.com/interpals/es-reindexer"
+	"github.com/jinzhu/gorm"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultBinlogServerId      = 1001
+	defaultBinlogFlavor        = "mysql"
+	defaultBinlogBatchSize     = 1000
+	defaultBinlogBatchInterval = time.Second
+)
+
+func streamPositionPath(configuration esreindexer.Configuration, model string) string {
+	return filepath.Join(configuration.GetStateDir(), model+".stream.json")
+}
+
+// Replication client with credentials of the DSN, returns name of its database too
+func newBinlogSyncer(configuration esreindexer.BinlogConfig, dsn string) (*replication.BinlogSyncer, string, error) {
+	dsnConfig, err := mysqldriver.ParseDSN(dsn)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if dsnConfig.Net != "tcp" {
+		return nil, "", fmt.Errorf("binlog stream needs tcp connection, %s is configured", dsnConfig.Net)
+	}
+
+	host, portString, err := net.SplitHostPort(dsnConfig.Addr)
+	if err != nil {
+		return nil, "", err
+	}
+
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, "", err
+	}
+
+	syncerConfig := replication.BinlogSyncerConfig{
+		ServerID: defaultBinlogServerId,
+		Flavor:   defaultBinlogFlavor,
+		Host:     host,
+		Port:     uint16(port),
+		User:     dsnConfig.User,
+		Password: dsnConfig.Passwd,
+	}
+
+	if configuration.ServerId > 0 {
+		syncerConfig.ServerID = configuration.ServerId
+	}
+
+	if configuration.Flavor != "" {
+		syncerConfig.Flavor = configuration.Flavor
+	}
+
+	return replication.NewBinlogSyncer(syncerConfig), dsnConfig.DBName, nil
+}
+
+// Current binlog position of the server
+func masterPosition(ctx context.Context, db *gorm.DB, configuration esreindexer.DataBaseConfig) (mysql.Position, error) {
+	var position mysql.Position
+
+	err := queryPage(ctx, db, configuration, "SHOW MASTER STATUS", func(rows *sql.Rows) (int, error) {
+		columns, err := rows.Columns()
+		if err != nil {
+			return 0, err
+		}
+
+		// Number of columns depends on the server version, only File and Position are needed
+		values := make([]sql.RawBytes, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+
+		count := 0
+
+		for rows.Next() {
+			err = rows.Scan(pointers...)
+			if err != nil {
+				return 0, err
+			}
+
+			pos, err := strconv.ParseUint(string(values[1]), 10, 32)
+			if err != nil {
+				return 0, err
+			}
+
+			position = mysql.Position{Name: string(values[0]), Pos: uint32(pos)}
+			count++
+		}
+
+		return count, nil
+	})
+
+	if err != nil {
+		return position, err
+	}
+
+	if position.Name == "" {
+		return position, fmt.Errorf("binary log is disabled, enable log-bin with binlog-format=ROW")
+	}
+
+	return position, nil
+}
+
+// Row events contain values by column positions, positions of id columns are read from information_schema
+func binlogColumns(
+	ctx context.Context,
+	db *gorm.DB,
+	configuration esreindexer.DataBaseConfig,
+	schema string,
+	tables map[string]string) (map[string]int, error) {
+
+	columns := map[string]int{}
+
+	for table, column := range tables {
+		err := queryPage(ctx, db, configuration, `
+		SELECT ORDINAL_POSITION
+		FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? AND COLUMN_NAME = ?`, func(rows *sql.Rows) (int, error) {
+			count := 0
+
+			for rows.Next() {
+				var position int
+
+				err := rows.Scan(&position)
+				if err != nil {
+					return 0, err
+				}
+
+				columns[table] = position - 1
+				count++
+			}
+
+			return count, nil
+		}, schema, table, column)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := columns[table]; !ok {
+			return nil, fmt.Errorf("there is no column %s.%s.%s", schema, table, column)
+		}
+	}
+
+	return columns, nil
+}
+
+func binlogId(value interface{}) (uint64, bool) {
+	switch id := value.(type) {
+	case int8:
+		return uint64(id), id >= 0
+	case int16:
+		return uint64(id), id >= 0
+	case int32:
+		return uint64(id), id >= 0
+	case int64:
+		return uint64(id), id >= 0
+	case uint8:
+		return uint64(id), true
+	case uint16:
+		return uint64(id), true
+	case uint32:
+		return uint64(id), true
+	case uint64:
+		return id, true
+	}
+
+	return 0, false
+}
+
+// Ids of changed rows and positions of the binlog stream
+type binlogState struct {
+	schema string
+
+	// Position of id column by table
+	columns map[string]int
+
+	// Position of the last event
+	current mysql.Position
+
+	// Position at the end of the last transaction, stream can be restarted from it
+	safe mysql.Position
+
+	ids     []uint64
+	changed map[uint64]bool
+}
+
+func newBinlogState(schema string, columns map[string]int, position mysql.Position) *binlogState {
+	return &binlogState{
+		schema:  schema,
+		columns: columns,
+		current: position,
+		safe:    position,
+		changed: map[uint64]bool{},
+	}
+}
+
+func (this *binlogState) Handle(event *replication.BinlogEvent) {
+	switch e := event.Event.(type) {
+	case *replication.RotateEvent:
+		this.current = mysql.Position{Name: string(e.NextLogName), Pos: uint32(e.Position)}
+		this.safe = this.current
+	case *replication.XIDEvent:
+		this.current.Pos = event.Header.LogPos
+		this.safe = this.current
+	case *replication.QueryEvent:
+		this.current.Pos = event.Header.LogPos
+
+		// Statements besides BEGIN are outside of transactions, for example DDL
+		if !strings.EqualFold(strings.TrimSpace(string(e.Query)), "BEGIN") {
+			this.safe = this.current
+		}
+	case *replication.RowsEvent:
+		this.current.Pos = event.Header.LogPos
+
+		column, ok := this.columns[string(e.Table.Table)]
+		if !ok || string(e.Table.Schema) != this.schema {
+			return
+		}
+
+		for _, row := range e.Rows {
+			if column >= len(row) {
+				continue
+			}
+
+			id, ok := binlogId(row[column])
+			if !ok || this.changed[id] {
+				continue
+			}
+
+			this.changed[id] = true
+			this.ids = append(this.ids, id)
+		}
+	default:
+		if event.Header.LogPos > 0 {
+			this.current.Pos = event.Header.LogPos
+		}
+	}
+}
+
+// Collected ids, the next batch starts empty
+func (this *binlogState) Take() []uint64 {
+	ids := this.ids
+
+	this.ids = nil
+	this.changed = map[uint64]bool{}
+
+	return ids
+}
+
+// Follows binlog from position and calls flush with ids from id columns of changed rows.
+// Ids are collected until batchSize or batchInterval, position passed to flush is at the end of a transaction,
+// so the stream can be restarted from it.
+func followBinlog(
+	ctx context.Context,
+	syncer *replication.BinlogSyncer,
+	position mysql.Position,
+	schema string,
+	columns map[string]int,
+	batchSize int,
+	batchInterval time.Duration,
+	flush func(ids []uint64, position mysql.Position) error) error {
+
+	streamer, err := syncer.StartSync(position)
+	if err != nil {
+		return err
+	}
+
+	var (
+		state   = newBinlogState(schema, columns, position)
+		flushed = position
+		due     = time.Now().Add(batchInterval)
+	)
+
+	for ctx.Err() == nil {
+		if len(state.ids) >= batchSize || (!time.Now().Before(due) && (len(state.ids) > 0 || state.safe != flushed)) {
+			safe := state.safe
+
+			err = flush(state.Take(), safe)
+			if err != nil {
+				return err
+			}
+
+			flushed = safe
+		}
+
+		if !time.Now().Before(due) {
+			due = time.Now().Add(batchInterval)
+		}
+
+		eventCtx, cancel := context.WithDeadline(ctx, due)
+		event, err := streamer.GetEvent(eventCtx)
+		cancel()
+
+		if err == context.DeadlineExceeded {
+			continue
+		}
+
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+
+			return err
+		}
+
+		state.Handle(event)
+	}
+
+	loggerFromContext(ctx).WithFields(logrus.Fields{"component": "db", "file": flushed.Name, "position": flushed.Pos}).Info("Binlog stream stopped")
+
+	return nil
+}
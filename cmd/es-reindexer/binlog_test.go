@@ -0,0 +1,159 @@
+// Copyright 2016-present InterPals. All Rights Reserved.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+)
+
+func binlogEvent(logPos uint32, event replication.Event) *replication.BinlogEvent {
+	return &replication.BinlogEvent{
+		Header: &replication.EventHeader{LogPos: logPos},
+		Event:  event,
+	}
+}
+
+func rowsEvent(schema string, table string, rows ...[]interface{}) *replication.RowsEvent {
+	return &replication.RowsEvent{
+		Table: &replication.TableMapEvent{Schema: []byte(schema), Table: []byte(table)},
+		Rows:  rows,
+	}
+}
+
+func TestBinlogStateRows(t *testing.T) {
+	tests := []struct {
+		name  string
+		event *replication.RowsEvent
+		ids   []uint64
+	}{
+		{"ids", rowsEvent("app", "users", []interface{}{"a", int32(1)}, []interface{}{"b", uint64(2)}), []uint64{1, 2}},
+		{"other schema", rowsEvent("other", "users", []interface{}{"a", int32(1)}), nil},
+		{"other table", rowsEvent("app", "photos", []interface{}{"a", int32(1)}), nil},
+		{"duplicate ids", rowsEvent("app", "users", []interface{}{"a", int32(1)}, []interface{}{"b", int32(1)}), []uint64{1}},
+		{"column out of range", rowsEvent("app", "users", []interface{}{"a"}, []interface{}{"b", int64(3)}), []uint64{3}},
+		{"not an id", rowsEvent("app", "users", []interface{}{"a", "1"}, []interface{}{"b", int8(-1)}), nil},
+	}
+
+	for _, test := range tests {
+		state := newBinlogState("app", map[string]int{"users": 1}, mysql.Position{Name: "binlog.000001", Pos: 4})
+		state.Handle(binlogEvent(100, test.event))
+
+		ids := state.Take()
+		if !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("%s: expected ids %v, got %v", test.name, test.ids, ids)
+		}
+
+		if state.current.Pos != 100 {
+			t.Errorf("%s: expected current position 100, got %d", test.name, state.current.Pos)
+		}
+
+		if state.safe.Pos != 4 {
+			t.Errorf("%s: rows must not move safe position, got %d", test.name, state.safe.Pos)
+		}
+	}
+}
+
+func TestBinlogStateTake(t *testing.T) {
+	state := newBinlogState("app", map[string]int{"users": 0}, mysql.Position{})
+
+	state.Handle(binlogEvent(10, rowsEvent("app", "users", []interface{}{uint32(1)})))
+	state.Take()
+
+	// The same id is collected again by the next batch
+	state.Handle(binlogEvent(20, rowsEvent("app", "users", []interface{}{uint32(1)})))
+	if ids := state.Take(); !reflect.DeepEqual(ids, []uint64{1}) {
+		t.Errorf("expected ids [1], got %v", ids)
+	}
+}
+
+func TestBinlogId(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		id    uint64
+		ok    bool
+	}{
+		{int8(5), 5, true},
+		{int16(-5), 0, false},
+		{int32(7), 7, true},
+		{int64(-1), 0, false},
+		{int64(1 << 40), 1 << 40, true},
+		{uint8(255), 255, true},
+		{uint16(65535), 65535, true},
+		{uint32(1 << 31), 1 << 31, true},
+		{uint64(1 << 63), 1 << 63, true},
+		{"1", 0, false},
+		{nil, 0, false},
+	}
+
+	for _, test := range tests {
+		id, ok := binlogId(test.value)
+		if ok != test.ok || (ok && id != test.id) {
+			t.Errorf("%#v: expected %d, %t, got %d, %t", test.value, test.id, test.ok, id, ok)
+		}
+	}
+}
+
+func TestBinlogStatePosition(t *testing.T) {
+	start := mysql.Position{Name: "binlog.000001", Pos: 4}
+
+	tests := []struct {
+		name    string
+		event   *replication.BinlogEvent
+		current mysql.Position
+		safe    mysql.Position
+	}{
+		{
+			"begin",
+			binlogEvent(100, &replication.QueryEvent{Query: []byte(" begin ")}),
+			mysql.Position{Name: "binlog.000001", Pos: 100},
+			start,
+		},
+		{
+			"xid",
+			binlogEvent(200, &replication.XIDEvent{}),
+			mysql.Position{Name: "binlog.000001", Pos: 200},
+			mysql.Position{Name: "binlog.000001", Pos: 200},
+		},
+		{
+			"ddl",
+			binlogEvent(300, &replication.QueryEvent{Query: []byte("ALTER TABLE users ADD COLUMN x INT")}),
+			mysql.Position{Name: "binlog.000001", Pos: 300},
+			mysql.Position{Name: "binlog.000001", Pos: 300},
+		},
+		{
+			"rotate",
+			binlogEvent(0, &replication.RotateEvent{Position: 4, NextLogName: []byte("binlog.000002")}),
+			mysql.Position{Name: "binlog.000002", Pos: 4},
+			mysql.Position{Name: "binlog.000002", Pos: 4},
+		},
+		{
+			"other event",
+			binlogEvent(400, &replication.GenericEvent{}),
+			mysql.Position{Name: "binlog.000001", Pos: 400},
+			start,
+		},
+		{
+			"other event without position",
+			binlogEvent(0, &replication.GenericEvent{}),
+			start,
+			start,
+		},
+	}
+
+	for _, test := range tests {
+		state := newBinlogState("app", map[string]int{}, start)
+		state.Handle(test.event)
+
+		if state.current != test.current {
+			t.Errorf("%s: expected current %+v, got %+v", test.name, test.current, state.current)
+		}
+
+		if state.safe != test.safe {
+			t.Errorf("%s: expected safe %+v, got %+v", test.name, test.safe, state.safe)
+		}
+	}
+}
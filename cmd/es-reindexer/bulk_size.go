@@ -0,0 +1,147 @@
+// Copyright 2016-present InterPals. All Rights Reserved.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	esreindexer "github.com/interpals/es-reindexer"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultMaxBulkBytes    = 5 * 1024 * 1024
+	defaultMinBulkLimit    = 10
+	defaultTargetLatency   = time.Second
+	bulkActionLineOverhead = 128
+)
+
+// Adjusts number of documents in bulk by Elasticsearch feedback:
+// shrinks it when cluster rejects requests or responds slowly and grows it back while latency is healthy.
+// Shared between processing goroutines.
+type bulkSizeController struct {
+	mutex sync.Mutex
+
+	limit    int
+	minLimit int
+	maxLimit int
+	maxBytes int
+
+	targetLatency time.Duration
+}
+
+func newBulkSizeController(configuration esreindexer.ElasticSearchConfig) *bulkSizeController {
+	controller := &bulkSizeController{
+		limit:         int(configuration.Limit),
+		minLimit:      defaultMinBulkLimit,
+		maxLimit:      int(configuration.Limit),
+		maxBytes:      defaultMaxBulkBytes,
+		targetLatency: defaultTargetLatency,
+	}
+
+	if configuration.MinLimit > 0 {
+		controller.minLimit = int(configuration.MinLimit)
+	}
+
+	if controller.minLimit > controller.maxLimit {
+		controller.minLimit = controller.maxLimit
+	}
+
+	if configuration.MaxBulkBytes > 0 {
+		controller.maxBytes = int(configuration.MaxBulkBytes)
+	}
+
+	if configuration.TargetLatency > 0 {
+		controller.targetLatency = time.Duration(configuration.TargetLatency) * time.Millisecond
+	}
+
+	return controller
+}
+
+// Current limit of documents in bulk
+func (this *bulkSizeController) Limit() int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	return this.limit
+}
+
+func (this *bulkSizeController) MaxBytes() int {
+	return this.maxBytes
+}
+
+// Record whose search data can't be encoded, it isn't sent and goes to the dead-letter file
+type unencodableRecord struct {
+	esreindexer.RawRecord
+
+	err error
+}
+
+func (this unencodableRecord) result() SinkItemResult {
+	return SinkItemResult{
+		Record:    this.RawRecord,
+		ErrorType: "serialization_error",
+		Error:     this.err.Error(),
+	}
+}
+
+// Encodes search data of record once, the encoded source is measured and sent as is.
+// Returns approximate size of record in bulk body.
+func encodeRecord(record esreindexer.FetchedRecord) (esreindexer.FetchedRecord, int) {
+	raw, ok := record.(esreindexer.RawRecord)
+	if !ok {
+		var err error
+
+		raw, err = esreindexer.NewRawRecord(record)
+		if err != nil {
+			// Only metadata is kept, size doesn't matter
+			return unencodableRecord{
+				RawRecord: esreindexer.RawRecord{
+					Index:  record.GetIndex(),
+					Type:   record.GetType(),
+					Id:     record.GetId(),
+					Parent: record.GetParent(),
+				},
+				err: err,
+			}, bulkActionLineOverhead
+		}
+	}
+
+	return raw, len(raw.Source) + bulkActionLineOverhead
+}
+
+// Called after every bulk attempt
+func (this *bulkSizeController) Observe(latency time.Duration, rejected bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	previous := this.limit
+
+	switch {
+	case rejected:
+		this.limit = this.limit / 2
+	case latency > this.targetLatency*2:
+		this.limit = this.limit * 3 / 4
+	case latency < this.targetLatency:
+		this.limit += this.limit/10 + 1
+	}
+
+	if this.limit < this.minLimit {
+		this.limit = this.minLimit
+	}
+
+	if this.limit > this.maxLimit {
+		this.limit = this.maxLimit
+	}
+
+	if this.limit < previous {
+		logger.WithFields(logrus.Fields{
+			"component": "es",
+			"from":      previous,
+			"limit":     this.limit,
+			"duration":  latency,
+			"rejected":  rejected,
+		}).Info("Bulk limit decreased")
+	}
+}
@@ -0,0 +1,453 @@
+// Copyright 2016-present InterPals. All Rights Reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	esreindexer "github.com/interpals/es-reindexer"
+	"github.com/sirupsen/logrus"
+)
+
+// How often checkpoint file is rewritten while records are acknowledged
+const checkpointSaveInterval = time.Second
+
+// Content of the checkpoint file
+type checkpointState struct {
+	Model   string `json:"model"`
+	Threads uint8  `json:"threads"`
+
+	// Last acknowledged id by partition key
+	Partitions map[string]uint64 `json:"partitions"`
+
+	// New index generation by alias, when index is rebuilt
+	Indices map[string]string `json:"indices,omitempty"`
+
+	// Position of delta sync, it's kept between runs
+	Watermark *watermark `json:"watermark,omitempty"`
+
+	Updated time.Time `json:"updated"`
+}
+
+// Value of the delta sort field and id of the last acknowledged record, id breaks ties of equal values
+type watermark struct {
+	Value string `json:"value"`
+	Id    uint64 `json:"id"`
+}
+
+// Delta sync has one partition, it moves the watermark instead of id
+const watermarkPartition = "watermark"
+
+// Page of records sent by fetch goroutine, partition can advance to its lastId (or watermark)
+// only when all records of the page and all previous pages are acknowledged
+type checkpointPage struct {
+	partition string
+	lastId    uint64
+	watermark *watermark
+	pending   int
+	count     int
+}
+
+// Tracks which fetched records are accepted by Elasticsearch and persists per partition progress.
+// nil tracker is valid and does nothing, it's used by runs without checkpoints.
+type checkpointTracker struct {
+	mutex sync.Mutex
+	path  string
+	state checkpointState
+
+	// Not acknowledged pages by partition, in order they were fetched
+	pages map[string][]*checkpointPage
+
+	// Pages of not acknowledged record by its key, in order they were fetched.
+	// The same record can be pending in several pages, for example when a stream fetches it again.
+	records map[string][]*checkpointPage
+
+	// Records of this run by partition, they aren't persisted
+	fetched      map[string]uint64
+	acknowledged map[string]uint64
+
+	dirty bool
+	saved time.Time
+}
+
+func checkpointPath(configuration esreindexer.Configuration, model string) string {
+	return filepath.Join(configuration.GetStateDir(), model+".checkpoint.json")
+}
+
+func watermarkPath(configuration esreindexer.Configuration, model string, field string) string {
+	return filepath.Join(configuration.GetStateDir(), model+"."+field+".watermark.json")
+}
+
+func partitionKey(prefix string, threadNumber uint64) string {
+	if prefix == "" {
+		return strconv.FormatUint(threadNumber, 10)
+	}
+
+	return prefix + "/" + strconv.FormatUint(threadNumber, 10)
+}
+
+func checkpointRecordKey(record esreindexer.FetchedRecord) string {
+	return record.GetIndex() + "/" + record.GetType() + "/" + strconv.FormatUint(record.GetId(), 10)
+}
+
+func newCheckpointTracker(path string, model string, threads uint8) *checkpointTracker {
+	return &checkpointTracker{
+		path: path,
+		state: checkpointState{
+			Model:      model,
+			Threads:    threads,
+			Partitions: map[string]uint64{},
+		},
+		pages:        map[string][]*checkpointPage{},
+		records:      map[string][]*checkpointPage{},
+		fetched:      map[string]uint64{},
+		acknowledged: map[string]uint64{},
+	}
+}
+
+// Loads checkpoint of previous run, it can be used only with the same model and number of threads,
+// because partitions are calculated as id % threads
+func resumeCheckpointTracker(path string, model string, threads uint8) (*checkpointTracker, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	tracker := newCheckpointTracker(path, model, threads)
+
+	err = json.Unmarshal(content, &tracker.state)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read checkpoint %s: %s", path, err)
+	}
+
+	if tracker.state.Model != model {
+		return nil, fmt.Errorf("checkpoint %s was created for %s, not %s", path, tracker.state.Model, model)
+	}
+
+	if tracker.state.Threads != threads {
+		return nil, fmt.Errorf(
+			"checkpoint %s was created with %d db threads, but %d are configured, resume with the same db.threads or start without -resume",
+			path,
+			tracker.state.Threads,
+			threads,
+		)
+	}
+
+	if tracker.state.Partitions == nil {
+		tracker.state.Partitions = map[string]uint64{}
+	}
+
+	return tracker, nil
+}
+
+// Loads watermark of the previous delta sync, there is no watermark before the first run
+func loadWatermarkTracker(path string, model string) (*checkpointTracker, error) {
+	tracker := newCheckpointTracker(path, model, 0)
+
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return tracker, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(content, &tracker.state)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read watermark %s: %s", path, err)
+	}
+
+	if tracker.state.Model != model {
+		return nil, fmt.Errorf("watermark %s was created for %s, not %s", path, tracker.state.Model, model)
+	}
+
+	if tracker.state.Partitions == nil {
+		tracker.state.Partitions = map[string]uint64{}
+	}
+
+	return tracker, nil
+}
+
+// Id to continue the partition from, 0 if there is no checkpoint
+func (this *checkpointTracker) LastId(partition string) uint64 {
+	if this == nil {
+		return 0
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	return this.state.Partitions[partition]
+}
+
+// Must be called before records of the page are sent to processing
+func (this *checkpointTracker) Track(partition string, lastId uint64, records []esreindexer.FetchedRecord) {
+	if this == nil {
+		return
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.track(&checkpointPage{
+		partition: partition,
+		lastId:    lastId,
+	}, records)
+}
+
+// Watermark to continue delta sync from, nil if there is no watermark yet
+func (this *checkpointTracker) Watermark() *watermark {
+	if this == nil {
+		return nil
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	return this.state.Watermark
+}
+
+// Same as Track, but the page moves watermark of delta sync
+func (this *checkpointTracker) TrackWatermark(mark watermark, records []esreindexer.FetchedRecord) {
+	if this == nil {
+		return
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.track(&checkpointPage{
+		partition: watermarkPartition,
+		watermark: &mark,
+	}, records)
+}
+
+func (this *checkpointTracker) track(page *checkpointPage, records []esreindexer.FetchedRecord) {
+	for _, record := range records {
+		key := checkpointRecordKey(record)
+
+		this.records[key] = append(this.records[key], page)
+		page.pending++
+	}
+
+	page.count = page.pending
+	this.fetched[page.partition] += uint64(page.count)
+
+	this.pages[page.partition] = append(this.pages[page.partition], page)
+	this.advance(page.partition)
+}
+
+// Marks records as accepted, records which are not tracked are ignored.
+// Acknowledged copy of a record clears its oldest pending page, so page of a newer copy waits for its own ack.
+func (this *checkpointTracker) Ack(records []esreindexer.FetchedRecord) {
+	if this == nil {
+		return
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	partitions := map[string]bool{}
+
+	for _, record := range records {
+		key := checkpointRecordKey(record)
+
+		pages := this.records[key]
+		if len(pages) == 0 {
+			continue
+		}
+
+		page := pages[0]
+
+		if len(pages) == 1 {
+			delete(this.records, key)
+		} else {
+			this.records[key] = pages[1:]
+		}
+
+		page.pending--
+		partitions[page.partition] = true
+	}
+
+	for partition := range partitions {
+		this.advance(partition)
+	}
+
+	if this.dirty && time.Since(this.saved) >= checkpointSaveInterval {
+		err := this.save()
+		if err != nil {
+			logger.WithFields(logrus.Fields{"component": "checkpoint", "path": this.path}).WithError(err).Warn("Cannot save checkpoint")
+		}
+	}
+}
+
+// Moves partition forward over fully acknowledged pages
+func (this *checkpointTracker) advance(partition string) {
+	pages := this.pages[partition]
+
+	for len(pages) > 0 && pages[0].pending == 0 {
+		if pages[0].watermark != nil {
+			this.state.Watermark = pages[0].watermark
+		} else {
+			this.state.Partitions[partition] = pages[0].lastId
+		}
+
+		this.acknowledged[partition] += uint64(pages[0].count)
+		this.dirty = true
+
+		pages = pages[1:]
+	}
+
+	this.pages[partition] = pages
+}
+
+func (this *checkpointTracker) save() error {
+	// Detached
+	if this.path == "" {
+		return nil
+	}
+
+	this.state.Updated = time.Now()
+
+	content, err := json.MarshalIndent(this.state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomically(this.path, content)
+	if err != nil {
+		return err
+	}
+
+	this.dirty = false
+	this.saved = time.Now()
+
+	return nil
+}
+
+// Write and rename, so crash in the middle of write doesn't break the previous content
+func writeFileAtomically(path string, content []byte) error {
+	tmpPath := path + ".tmp"
+
+	err := ioutil.WriteFile(tmpPath, content, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// Persists the latest acknowledged state
+func (this *checkpointTracker) Save() error {
+	if this == nil {
+		return nil
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	return this.save()
+}
+
+// Progress of the partition in this run
+type partitionProgress struct {
+	LastId       uint64 `json:"last-id"`
+	Fetched      uint64 `json:"fetched"`
+	Acknowledged uint64 `json:"acknowledged"`
+}
+
+// Progress of partitions by partition key, delta and stream have the watermark partition only
+func (this *checkpointTracker) Progress() map[string]partitionProgress {
+	result := map[string]partitionProgress{}
+
+	if this == nil {
+		return result
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	for partition, lastId := range this.state.Partitions {
+		progress := result[partition]
+		progress.LastId = lastId
+		result[partition] = progress
+	}
+
+	for partition, count := range this.fetched {
+		progress := result[partition]
+		progress.Fetched = count
+		progress.Acknowledged = this.acknowledged[partition]
+		result[partition] = progress
+	}
+
+	return result
+}
+
+// Index generation which the interrupted run was writing to
+func (this *checkpointTracker) Index(alias string) string {
+	if this == nil {
+		return ""
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	return this.state.Indices[alias]
+}
+
+func (this *checkpointTracker) SetIndex(alias string, index string) {
+	if this == nil {
+		return
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.state.Indices == nil {
+		this.state.Indices = map[string]string{}
+	}
+
+	this.state.Indices[alias] = index
+	this.dirty = true
+}
+
+// State is kept in memory only, for example by dry run, which must not move checkpoints and watermarks
+func (this *checkpointTracker) Detach() {
+	if this == nil {
+		return
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.path = ""
+}
+
+// Run is finished, there is nothing to resume
+func (this *checkpointTracker) Remove() error {
+	if this == nil {
+		return nil
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.path == "" {
+		return nil
+	}
+
+	err := os.Remove(this.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,117 @@
+// Copyright 2016-present InterPals. All Rights Reserved.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	esreindexer "github.com/interpals/es-reindexer"
+)
+
+func testRecords(ids ...uint64) []esreindexer.FetchedRecord {
+	records := make([]esreindexer.FetchedRecord, len(ids))
+	for i, id := range ids {
+		records[i] = newTestRecord(id, 10)
+	}
+
+	return records
+}
+
+func TestCheckpointAckOutOfOrder(t *testing.T) {
+	tracker := newCheckpointTracker("", "users", 1)
+
+	tracker.Track("0", 3, testRecords(1, 2, 3))
+	tracker.Track("0", 6, testRecords(4, 5, 6))
+
+	// The second page can't move the partition before the first one
+	tracker.Ack(testRecords(4, 5, 6))
+	if lastId := tracker.LastId("0"); lastId != 0 {
+		t.Fatalf("expected last id 0, got %d", lastId)
+	}
+
+	tracker.Ack(testRecords(1, 2))
+	if lastId := tracker.LastId("0"); lastId != 0 {
+		t.Fatalf("expected last id 0, got %d", lastId)
+	}
+
+	tracker.Ack(testRecords(3))
+	if lastId := tracker.LastId("0"); lastId != 6 {
+		t.Fatalf("expected last id 6, got %d", lastId)
+	}
+
+	progress := tracker.Progress()["0"]
+	if progress.Fetched != 6 || progress.Acknowledged != 6 {
+		t.Errorf("expected 6 fetched and acknowledged records, got %+v", progress)
+	}
+}
+
+func TestCheckpointDuplicateIdsAcrossPages(t *testing.T) {
+	tracker := newCheckpointTracker("", "users", 0)
+
+	tracker.TrackWatermark(watermark{Value: "a", Id: 2}, testRecords(1, 2))
+	tracker.TrackWatermark(watermark{Value: "b", Id: 1}, testRecords(1))
+
+	// The first copy clears the first page only
+	tracker.Ack(testRecords(1, 2))
+	if mark := tracker.Watermark(); mark == nil || mark.Value != "a" {
+		t.Fatalf("expected watermark a, got %+v", mark)
+	}
+
+	tracker.Ack(testRecords(1))
+	if mark := tracker.Watermark(); mark == nil || mark.Value != "b" {
+		t.Fatalf("expected watermark b, got %+v", mark)
+	}
+
+	progress := tracker.Progress()[watermarkPartition]
+	if progress.Fetched != 3 || progress.Acknowledged != 3 {
+		t.Errorf("expected 3 fetched and acknowledged records, got %+v", progress)
+	}
+
+	if len(tracker.records) != 0 {
+		t.Errorf("expected no pending records, got %d", len(tracker.records))
+	}
+
+	// Records which aren't tracked are ignored
+	tracker.Ack(testRecords(1))
+	if progress := tracker.Progress()[watermarkPartition]; progress.Acknowledged != 3 {
+		t.Errorf("expected 3 acknowledged records, got %d", progress.Acknowledged)
+	}
+}
+
+func TestCheckpointDetach(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "users.checkpoint.json")
+
+	tracker := newCheckpointTracker(path, "users", 1)
+	tracker.Detach()
+
+	tracker.Track("0", 2, testRecords(1, 2))
+	tracker.Ack(testRecords(1, 2))
+
+	err = tracker.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tracker.LastId("0") != 2 {
+		t.Errorf("expected last id 2 in memory, got %d", tracker.LastId("0"))
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("detached checkpoint must not be saved to %s", path)
+	}
+
+	err = tracker.Remove()
+	if err != nil {
+		t.Errorf("remove of detached checkpoint: %s", err)
+	}
+}
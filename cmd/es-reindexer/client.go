@@ -0,0 +1,152 @@
+// Copyright 2016-present InterPals. All Rights Reserved.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	esreindexer "github.com/interpals/es-reindexer"
+	"github.com/olivere/elastic"
+)
+
+// Adds API key to every request, the client has only basic auth
+type apiKeyTransport struct {
+	apiKey    string
+	transport http.RoundTripper
+}
+
+func (this *apiKeyTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	// Shallow copy, RoundTripper must not modify the request
+	request = request.WithContext(request.Context())
+	request.Header = cloneHeader(request.Header)
+	request.Header.Set("Authorization", "ApiKey "+this.apiKey)
+
+	return this.transport.RoundTrip(request)
+}
+
+func cloneHeader(header http.Header) http.Header {
+	result := make(http.Header, len(header))
+	for key, values := range header {
+		result[key] = append([]string(nil), values...)
+	}
+
+	return result
+}
+
+// "id:key" is encoded, otherwise it's already the encoded key of the create API key response
+func encodeApiKey(apiKey string) string {
+	if strings.Contains(apiKey, ":") {
+		return base64.StdEncoding.EncodeToString([]byte(apiKey))
+	}
+
+	return apiKey
+}
+
+func newTlsConfig(cluster esreindexer.ClusterConfig) (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: cluster.InsecureSkipVerify,
+	}
+
+	if cluster.CaFile != "" {
+		content, err := ioutil.ReadFile(cluster.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("ca-file: %s", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("ca-file: no certificates in %s", cluster.CaFile)
+		}
+
+		config.RootCAs = pool
+	}
+
+	if cluster.CertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(cluster.CertFile, cluster.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cert-file: %s", err)
+		}
+
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return config, nil
+}
+
+// Cluster of -cluster flag, the connection of elasticsearch section without it.
+// Urls are required only here, dry run doesn't connect to Elasticsearch.
+func selectCluster(configuration esreindexer.ElasticSearchConfig, name string) (esreindexer.ClusterConfig, error) {
+	if name == "" {
+		if len(configuration.GetUrls()) == 0 {
+			return configuration.ClusterConfig, errors.New("elasticsearch.urls is required")
+		}
+
+		return configuration.ClusterConfig, nil
+	}
+
+	cluster, ok := configuration.Clusters[name]
+	if !ok {
+		return cluster, fmt.Errorf("cluster %q is not defined in elasticsearch.clusters", name)
+	}
+
+	if len(cluster.GetUrls()) == 0 {
+		return cluster, fmt.Errorf("elasticsearch.clusters.%s.urls is required", name)
+	}
+
+	return cluster, nil
+}
+
+func newElasticClient(cluster esreindexer.ClusterConfig) (*elastic.Client, error) {
+	urls := cluster.GetUrls()
+
+	tlsConfig, err := newTlsConfig(cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	var transport http.RoundTripper = &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConnsPerHost: 16,
+		IdleConnTimeout:     90 * time.Second,
+	}
+
+	if cluster.ApiKey != "" {
+		transport = &apiKeyTransport{
+			apiKey:    encodeApiKey(cluster.ApiKey),
+			transport: transport,
+		}
+	}
+
+	httpClient := &http.Client{
+		Transport: transport,
+		Timeout:   time.Duration(cluster.Timeout) * time.Millisecond,
+	}
+
+	options := []elastic.ClientOptionFunc{
+		elastic.SetURL(urls...),
+		elastic.SetHttpClient(httpClient),
+		elastic.SetSniff(cluster.Sniff),
+		elastic.SetHealthcheck(cluster.Healthcheck),
+	}
+
+	// Sniffed nodes are addressed by the scheme of the client
+	if len(urls) > 0 && strings.HasPrefix(urls[0], "https://") {
+		options = append(options, elastic.SetScheme("https"))
+	}
+
+	if cluster.Username != "" {
+		options = append(options, elastic.SetBasicAuth(cluster.Username, cluster.Password))
+	}
+
+	return elastic.NewClient(options...)
+}
@@ -0,0 +1,59 @@
+// Copyright 2016-present InterPals. All Rights Reserved.
+
+package main
+
+import (
+	"context"
+
+	esreindexer "github.com/interpals/es-reindexer"
+)
+
+// Records of a single run, totalFetch and totalSend count all runs of the process
+type runCounters struct {
+	fetched esreindexer.Counter
+	sent    esreindexer.Counter
+}
+
+type runCountersKey struct{}
+
+func withRunCounters(ctx context.Context, counters *runCounters) context.Context {
+	return context.WithValue(ctx, runCountersKey{}, counters)
+}
+
+// Counters of the run, nil outside of a run
+func runCountersFromContext(ctx context.Context) *runCounters {
+	counters, _ := ctx.Value(runCountersKey{}).(*runCounters)
+	return counters
+}
+
+func (this *runCounters) Fetched() uint64 {
+	if this == nil {
+		return 0
+	}
+
+	return this.fetched.Value()
+}
+
+func (this *runCounters) Sent() uint64 {
+	if this == nil {
+		return 0
+	}
+
+	return this.sent.Value()
+}
+
+func countFetched(ctx context.Context, n uint64) {
+	totalFetch.Add(n)
+
+	if counters := runCountersFromContext(ctx); counters != nil {
+		counters.fetched.Add(n)
+	}
+}
+
+func countSent(ctx context.Context, n uint64) {
+	totalSend.Add(n)
+
+	if counters := runCountersFromContext(ctx); counters != nil {
+		counters.sent.Add(n)
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2016-present InterPals. All Rights Reserved.
+
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRunCountersOfConcurrentRuns(t *testing.T) {
+	registry := &runRegistry{runs: map[string]*activeRun{}}
+
+	first, second := &runCounters{}, &runCounters{}
+	firstCtx := withRunCounters(context.Background(), first)
+	secondCtx := withRunCounters(context.Background(), second)
+
+	removeFirst := registry.Add("users-hourly", "users-delta", first, nil, nil)
+	removeSecond := registry.Add("users-nightly", "users-delta", second, nil, nil)
+
+	countFetched(firstCtx, 3)
+	countSent(firstCtx, 2)
+	countFetched(secondCtx, 10)
+
+	// Records outside of a run are counted by totals only
+	countFetched(context.Background(), 100)
+
+	status := registry.Status()
+	if len(status) != 2 {
+		t.Fatalf("expected 2 runs, got %d", len(status))
+	}
+
+	hourly := status["users-hourly"].(map[string]interface{})
+	if hourly["fetched"] != uint64(3) || hourly["sent"] != uint64(2) || hourly["command"] != "users-delta" {
+		t.Errorf("unexpected status of users-hourly: %v", hourly)
+	}
+
+	nightly := status["users-nightly"].(map[string]interface{})
+	if nightly["fetched"] != uint64(10) || nightly["sent"] != uint64(0) {
+		t.Errorf("unexpected status of users-nightly: %v", nightly)
+	}
+
+	removeFirst()
+	removeSecond()
+
+	if len(registry.Status()) != 0 {
+		t.Errorf("runs must be removed")
+	}
+}
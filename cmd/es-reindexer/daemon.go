@@ -0,0 +1,379 @@
+// Copyright 2016-present InterPals. All Rights Reserved.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	esreindexer "github.com/interpals/es-reindexer"
+	"github.com/olivere/elastic"
+	"github.com/sirupsen/logrus"
+)
+
+// State of daemon job, it's kept between restarts of daemon
+type jobStatus struct {
+	Running     bool      `json:"running"`
+	LastStart   time.Time `json:"last-start"`
+	LastSuccess time.Time `json:"last-success"`
+	LastError   string    `json:"last-error,omitempty"`
+	Failures    uint      `json:"failures"`
+	NextRun     time.Time `json:"next-run"`
+}
+
+// Runs configured jobs on their schedules with shared DB and ES connections,
+// failed job is repeated with backoff and doesn't affect others
+type daemon struct {
+	client *elastic.Client
+	dbs    *databases
+	config esreindexer.Configuration
+
+	mutex  sync.Mutex
+	path   string
+	status map[string]*jobStatus
+
+	// Jobs of the same model share index and state files, they wait for each other
+	locks map[string]chan struct{}
+}
+
+func newDaemon(client *elastic.Client, dbs *databases, config esreindexer.Configuration) *daemon {
+	return &daemon{
+		client: client,
+		dbs:    dbs,
+		config: config,
+		path:   filepath.Join(config.GetStateDir(), "daemon.status.json"),
+		status: map[string]*jobStatus{},
+		locks:  map[string]chan struct{}{},
+	}
+}
+
+// Commands which can be run by daemon, they don't need arguments
+func isJobCommand(command string) bool {
+	if command == "replay-dlq" {
+		return true
+	}
+
+	for _, sourceCommand := range sourceCommands() {
+		if command == sourceCommand {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Key of the lock which serializes the job with others, empty for streams.
+// Stream runs until daemon stops, so it would block the other jobs of its model forever.
+func jobLockKey(command string) string {
+	if strings.HasSuffix(command, "-stream") {
+		return ""
+	}
+
+	return strings.TrimSuffix(command, "-delta")
+}
+
+func validateJobs(jobs []esreindexer.JobConfig) error {
+	if len(jobs) == 0 {
+		return fmt.Errorf("daemon.jobs must be configured")
+	}
+
+	names := map[string]bool{}
+
+	for _, job := range jobs {
+		if job.Name == "" || names[job.Name] {
+			return fmt.Errorf("daemon job must have unique name, got %q", job.Name)
+		}
+
+		names[job.Name] = true
+
+		if !isJobCommand(job.Command) {
+			return fmt.Errorf("job %s: unknown command %q", job.Name, job.Command)
+		}
+
+		// Everything but stream finishes, without schedule it would be restarted right away
+		if job.Interval == 0 && job.At == "" && !strings.HasSuffix(job.Command, "-stream") {
+			return fmt.Errorf("job %s: interval or at is required", job.Name)
+		}
+
+		if job.At != "" {
+			_, err := parseTimeOfDay(job.At)
+			if err != nil {
+				return fmt.Errorf("job %s: %s", job.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func jobOptions(config esreindexer.Configuration, job esreindexer.JobConfig) runOptions {
+	options := runOptions{
+		job:           job.Name,
+		command:       job.Command,
+		field:         job.Field,
+		maxTotalFetch: job.Total,
+		rebuild:       job.Rebuild,
+	}
+
+	if options.field == "" {
+		options.field = "signup"
+	}
+
+	if options.maxTotalFetch == 0 {
+		options.maxTotalFetch = 1000
+	}
+
+	// Full reindex which failed or was interrupted continues from its checkpoint
+	if _, ok := lookupSource(job.Command); ok {
+		_, err := os.Stat(checkpointPath(config, job.Command))
+		options.resume = err == nil
+	}
+
+	return options
+}
+
+// Next scheduled run after the previous one started
+func nextJobRun(job esreindexer.JobConfig, previous time.Time, now time.Time) time.Time {
+	if job.At != "" {
+		at, _ := parseTimeOfDay(job.At)
+
+		midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+		next := midnight.Add(at)
+		if !next.After(now) {
+			next = next.AddDate(0, 0, 1)
+		}
+
+		return next
+	}
+
+	next := previous.Add(time.Duration(job.Interval) * time.Second)
+	if next.Before(now) {
+		return now
+	}
+
+	return next
+}
+
+func (this *daemon) load() error {
+	content, err := ioutil.ReadFile(this.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(content, &this.status)
+}
+
+// Must be called under mutex
+func (this *daemon) save() {
+	content, err := json.MarshalIndent(this.status, "", "  ")
+	if err == nil {
+		err = writeFileAtomically(this.path, content)
+	}
+
+	if err != nil {
+		logger.WithFields(logrus.Fields{"component": "daemon", "path": this.path}).WithError(err).Warn("Cannot save status")
+	}
+}
+
+func (this *daemon) update(name string, change func(status *jobStatus)) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	status, ok := this.status[name]
+	if !ok {
+		status = &jobStatus{}
+		this.status[name] = status
+	}
+
+	change(status)
+	this.save()
+}
+
+// Copy of jobs status by job name
+func (this *daemon) Status() map[string]jobStatus {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	result := map[string]jobStatus{}
+	for name, status := range this.status {
+		result[name] = *status
+	}
+
+	return result
+}
+
+// Runs jobs until ctx is cancelled, running jobs are finished like interrupted runs
+func (this *daemon) Run(ctx context.Context) error {
+	jobs := this.config.Daemon.Jobs
+
+	err := validateJobs(jobs)
+	if err != nil {
+		return err
+	}
+
+	err = this.load()
+	if err != nil {
+		return fmt.Errorf("cannot read daemon status %s: %s", this.path, err)
+	}
+
+	for _, job := range jobs {
+		if key := jobLockKey(job.Command); key != "" {
+			this.locks[key] = make(chan struct{}, 1)
+		}
+	}
+
+	var wg *sync.WaitGroup = new(sync.WaitGroup)
+
+	for _, job := range jobs {
+		wg.Add(1)
+		go this.runJob(ctx, job, wg)
+	}
+
+	wg.Wait()
+
+	logger.WithField("component", "daemon").Info("All jobs are stopped")
+
+	return nil
+}
+
+func (this *daemon) runJob(ctx context.Context, job esreindexer.JobConfig, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	var (
+		failures uint
+		next     time.Time
+
+		jobLog = logger.WithFields(logrus.Fields{"component": "daemon", "job": job.Name, "command": job.Command})
+	)
+
+	this.update(job.Name, func(status *jobStatus) {
+		status.Running = false
+		failures = status.Failures
+
+		// Schedule continues from the last start, so restart of daemon doesn't run all jobs at once
+		next = nextJobRun(job, status.LastStart, time.Now())
+	})
+
+	for {
+		this.update(job.Name, func(status *jobStatus) {
+			status.NextRun = next
+		})
+
+		jobLog.WithField("next-run", next.Format(time.RFC3339)).Info("Job is scheduled")
+
+		select {
+		case <-time.After(time.Until(next)):
+		case <-ctx.Done():
+			return
+		}
+
+		if !this.lock(ctx, job, jobLog) {
+			return
+		}
+
+		started := time.Now()
+
+		this.update(job.Name, func(status *jobStatus) {
+			status.Running = true
+			status.LastStart = started
+		})
+
+		jobLog.Info("Start job")
+
+		err := run(withLogger(ctx, logger.WithField("job", job.Name)), this.client, this.dbs, this.config, jobOptions(this.config, job))
+
+		this.unlock(job)
+
+		if err == errInterrupted || (err == nil && ctx.Err() != nil) {
+			this.update(job.Name, func(status *jobStatus) {
+				status.Running = false
+			})
+
+			jobLog.Info("Job is interrupted")
+			return
+		}
+
+		if err != nil {
+			failures++
+			next = time.Now().Add(retryDelay(this.config.Daemon.Retry, failures))
+
+			jobLog.WithField("failures", failures).WithError(err).Error("Job failed")
+		} else {
+			failures = 0
+			next = nextJobRun(job, started, time.Now())
+
+			jobLog.WithField("duration", time.Since(started)).Info("Job succeeded")
+		}
+
+		this.update(job.Name, func(status *jobStatus) {
+			status.Running = false
+			status.Failures = failures
+
+			if err != nil {
+				status.LastError = err.Error()
+			} else {
+				status.LastSuccess = time.Now()
+				status.LastError = ""
+			}
+		})
+
+		this.logStatus()
+	}
+}
+
+// Waits until other jobs of the model finish, false if ctx is cancelled meanwhile
+func (this *daemon) lock(ctx context.Context, job esreindexer.JobConfig, jobLog *logrus.Entry) bool {
+	lock, ok := this.locks[jobLockKey(job.Command)]
+	if !ok {
+		return true
+	}
+
+	select {
+	case lock <- struct{}{}:
+		return true
+	default:
+	}
+
+	jobLog.Info("Job waits for another job of the model")
+
+	select {
+	case lock <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (this *daemon) unlock(job esreindexer.JobConfig) {
+	if lock, ok := this.locks[jobLockKey(job.Command)]; ok {
+		<-lock
+	}
+}
+
+// Last success of every job, they are logged after each run
+func (this *daemon) logStatus() {
+	for name, status := range this.Status() {
+		lastSuccess := "never"
+		if !status.LastSuccess.IsZero() {
+			lastSuccess = status.LastSuccess.Format(time.RFC3339)
+		}
+
+		logger.WithFields(logrus.Fields{
+			"component":    "daemon",
+			"job":          name,
+			"last-success": lastSuccess,
+			"failures":     status.Failures,
+		}).Info("Job status")
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2016-present InterPals. All Rights Reserved.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	esreindexer "github.com/interpals/es-reindexer"
+)
+
+func TestValidateJobs(t *testing.T) {
+	valid := []esreindexer.JobConfig{
+		{Name: "users-delta", Command: "users-delta", Interval: 60},
+		{Name: "users-rebuild", Command: "users", Rebuild: true, At: "02:00"},
+		{Name: "users-stream", Command: "users-stream"},
+		{Name: "replay", Command: "replay-dlq", Interval: 3600},
+	}
+
+	err := validateJobs(valid)
+	if err != nil {
+		t.Errorf("expected valid jobs, got %s", err)
+	}
+
+	tests := []struct {
+		name string
+		job  esreindexer.JobConfig
+	}{
+		{"unknown command", esreindexer.JobConfig{Name: "job", Command: "user", Interval: 60}},
+		{"command with argument", esreindexer.JobConfig{Name: "job", Command: "verify", Interval: 60}},
+		{"without schedule", esreindexer.JobConfig{Name: "job", Command: "users-delta"}},
+		{"wrong time", esreindexer.JobConfig{Name: "job", Command: "geo", At: "25:00"}},
+		{"duplicate name", esreindexer.JobConfig{Name: "users-delta", Command: "geo", Interval: 60}},
+	}
+
+	for _, test := range tests {
+		err := validateJobs(append(valid[:1:1], test.job))
+		if err == nil {
+			t.Errorf("%s: expected error", test.name)
+		}
+	}
+}
+
+func TestJobsOfModelAreSerialized(t *testing.T) {
+	if jobLockKey("users-delta") != "users" || jobLockKey("users") != "users" || jobLockKey("users-stream") != "" {
+		t.Fatal("delta and full reindex of the model must share the lock, stream must not take it")
+	}
+
+	daemon := &daemon{locks: map[string]chan struct{}{"users": make(chan struct{}, 1)}}
+	rebuild := esreindexer.JobConfig{Name: "users-rebuild", Command: "users"}
+	delta := esreindexer.JobConfig{Name: "users-delta", Command: "users-delta"}
+
+	if !daemon.lock(context.Background(), rebuild, logger.WithField("job", rebuild.Name)) {
+		t.Fatal("free lock must be taken")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if daemon.lock(ctx, delta, logger.WithField("job", delta.Name)) {
+		t.Fatal("delta must wait while rebuild runs")
+	}
+
+	daemon.unlock(rebuild)
+
+	if !daemon.lock(context.Background(), delta, logger.WithField("job", delta.Name)) {
+		t.Error("delta must run after rebuild")
+	}
+}
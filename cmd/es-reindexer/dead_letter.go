@@ -0,0 +1,145 @@
+// Copyright 2016-present InterPals. All Rights Reserved.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	esreindexer "github.com/interpals/es-reindexer"
+	"github.com/sirupsen/logrus"
+)
+
+// Record which was permanently rejected, one JSON object per line in the dead-letter file
+type deadLetter struct {
+	esreindexer.RawRecord
+
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+}
+
+// Appends permanently failed records to NDJSON file, safe for concurrent use
+type deadLetterWriter struct {
+	mutex sync.Mutex
+	path  string
+	file  *os.File
+	count uint64
+}
+
+func newDeadLetterWriter(path string) *deadLetterWriter {
+	return &deadLetterWriter{
+		path: path,
+	}
+}
+
+func (this *deadLetterWriter) Write(results []SinkItemResult) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	// File is created on the first failure only, so successful runs don't leave empty files
+	if this.file == nil {
+		file, err := os.OpenFile(this.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+
+		this.file = file
+	}
+
+	writer := bufio.NewWriter(this.file)
+	encoder := json.NewEncoder(writer)
+
+	for _, result := range results {
+		record, err := esreindexer.NewRawRecord(result.Record)
+		if err != nil {
+			return err
+		}
+
+		err = encoder.Encode(deadLetter{
+			RawRecord: record,
+			Status:    result.Status,
+			Error:     result.ErrorType + ": " + result.Error,
+		})
+
+		if err != nil {
+			return err
+		}
+
+		this.count++
+	}
+
+	return writer.Flush()
+}
+
+func (this *deadLetterWriter) Count() uint64 {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	return this.count
+}
+
+func (this *deadLetterWriter) Close() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.file == nil {
+		return nil
+	}
+
+	err := this.file.Close()
+	this.file = nil
+
+	return err
+}
+
+// Moves dead-letter file aside, so records which fail again are written into a fresh file
+func takeDeadLetters(path string) (string, error) {
+	replayPath := path + ".replay-" + strconv.FormatInt(time.Now().Unix(), 10)
+
+	return replayPath, os.Rename(path, replayPath)
+}
+
+// Reads dead-letter file and sends its records to the channel
+func replayDeadLetters(
+	ctx context.Context,
+	fatal *fatalError,
+	path string,
+	channel chan esreindexer.FetchedRecord) {
+
+	defer close(channel)
+
+	file, err := os.Open(path)
+	if err != nil {
+		fatal.Report(err)
+		return
+	}
+
+	defer file.Close()
+
+	var count uint64
+
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	for decoder.More() {
+		var letter deadLetter
+
+		err := decoder.Decode(&letter)
+		if err != nil {
+			fatal.Report(err)
+			return
+		}
+
+		if !sendRecord(ctx, channel, letter.RawRecord) {
+			return
+		}
+
+		count++
+		countFetched(ctx, 1)
+	}
+
+	loggerFromContext(ctx).WithFields(logrus.Fields{"count": count, "path": path}).Info("Replayed dead letters")
+}
@@ -0,0 +1,112 @@
+// Copyright 2016-present InterPals. All Rights Reserved.
+
+package main
+
+import (
+	esreindexer "github.com/interpals/es-reindexer"
+)
+
+// Parts of queries which differ between databases, chosen by db.dialect.
+// Queries of both dialects return the same rows, so documents are identical.
+type sqlDialect interface {
+	// Values of the group joined by separator
+	GroupConcat(expression string, separator string) string
+
+	// Subquery with ORDER BY and LIMIT which can be used by IN
+	LimitedSubquery(query string) string
+
+	// Sort orders with NULLs placed like MySQL does: first in ascending order, last in descending
+	Asc(column string) string
+	Desc(column string) string
+
+	// Column which is 1 or true
+	IsTrue(column string) string
+
+	// Select expressions of DATETIME (or timestamp) and DATE columns named as name,
+	// formatted like MySQL returns them: "2006-01-02 15:04:05" and "2006-01-02"
+	DateTime(column string, name string) string
+	Date(column string, name string) string
+
+	// Identifier in camel case, PostgreSQL folds unquoted ones to lower case
+	Identifier(name string) string
+}
+
+type mysqlDialect struct{}
+
+func (mysqlDialect) GroupConcat(expression string, separator string) string {
+	return `GROUP_CONCAT(` + expression + ` SEPARATOR '` + separator + `')`
+}
+
+// MySQL doesn't allow LIMIT in IN subqueries, but it does in derived tables
+func (mysqlDialect) LimitedSubquery(query string) string {
+	return `SELECT * FROM (` + query + `) t`
+}
+
+func (mysqlDialect) Asc(column string) string {
+	return column + ` ASC`
+}
+
+func (mysqlDialect) Desc(column string) string {
+	return column + ` DESC`
+}
+
+func (mysqlDialect) IsTrue(column string) string {
+	return column + ` = 1`
+}
+
+func (mysqlDialect) DateTime(column string, name string) string {
+	return column
+}
+
+func (mysqlDialect) Date(column string, name string) string {
+	return column
+}
+
+func (mysqlDialect) Identifier(name string) string {
+	return name
+}
+
+type postgresDialect struct{}
+
+func (postgresDialect) GroupConcat(expression string, separator string) string {
+	return `string_agg(` + expression + `, '` + separator + `')`
+}
+
+func (postgresDialect) LimitedSubquery(query string) string {
+	return query
+}
+
+func (postgresDialect) Asc(column string) string {
+	return column + ` ASC NULLS FIRST`
+}
+
+func (postgresDialect) Desc(column string) string {
+	return column + ` DESC NULLS LAST`
+}
+
+// Migrated flags are smallint or boolean, both are cast to 1
+func (postgresDialect) IsTrue(column string) string {
+	return column + `::int = 1`
+}
+
+// Timestamps are scanned into strings as RFC 3339 otherwise
+func (postgresDialect) DateTime(column string, name string) string {
+	return `to_char(` + column + `, 'YYYY-MM-DD HH24:MI:SS') AS ` + name
+}
+
+func (postgresDialect) Date(column string, name string) string {
+	return `to_char(` + column + `, 'YYYY-MM-DD') AS ` + name
+}
+
+func (postgresDialect) Identifier(name string) string {
+	return `"` + name + `"`
+}
+
+// Validate allows only mysql and postgres
+func newSqlDialect(configuration esreindexer.DataBaseConfig) sqlDialect {
+	if configuration.Dialect == "postgres" {
+		return postgresDialect{}
+	}
+
+	return mysqlDialect{}
+}
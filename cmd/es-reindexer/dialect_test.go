@@ -0,0 +1,83 @@
+// Copyright 2016-present InterPals. All Rights Reserved.
+
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestUsersQueryDates(t *testing.T) {
+	postgres := createSelectUsersQuery(postgresDialect{}, "u.id ASC", "10", "u.id > 0")
+
+	for _, expression := range []string{
+		`to_char(u.last_login, 'YYYY-MM-DD HH24:MI:SS') AS last_login`,
+		`to_char(u.signup, 'YYYY-MM-DD HH24:MI:SS') AS signup`,
+		`to_char(u.modified, 'YYYY-MM-DD HH24:MI:SS') AS modified`,
+		`to_char(u.birth, 'YYYY-MM-DD') AS birth`,
+	} {
+		if !strings.Contains(postgres, expression) {
+			t.Errorf("postgres query doesn't contain %s", expression)
+		}
+	}
+
+	mysql := createSelectUsersQuery(mysqlDialect{}, "u.id ASC", "10", "u.id > 0")
+
+	if strings.Contains(mysql, "to_char") {
+		t.Errorf("mysql query must select dates as is")
+	}
+
+	for _, column := range []string{"u.last_login,", "u.signup,", "u.modified,", "u.birth,"} {
+		if !strings.Contains(mysql, column) {
+			t.Errorf("mysql query doesn't contain %s", column)
+		}
+	}
+}
+
+func TestGeoIdentifiers(t *testing.T) {
+	postgres := newGeoIdentifiers(postgresDialect{})
+	if postgres.admin1CodesAscii != `"admin1CodesAscii"` || postgres.isoLanguage != `"isoLanguage"` {
+		t.Errorf("postgres identifiers must be quoted, got %+v", postgres)
+	}
+
+	mysql := newGeoIdentifiers(mysqlDialect{})
+	if mysql.alternateName != `alternateName` || mysql.isShortName != `isShortName` {
+		t.Errorf("mysql identifiers must be kept, got %+v", mysql)
+	}
+}
+
+func TestPostgresQueriesHaveNoMySQLClauses(t *testing.T) {
+	dialect := postgresDialect{}
+
+	queries := map[string]string{
+		"users":     createSelectUsersQuery(dialect, "u.id ASC", "10", "u.id > 0"),
+		"countries": createSelectCountriesQuery(dialect),
+		"regions":   createSelectRegionsQuery(dialect, 0, "4", "1", "10"),
+		"cities":    createSelectCitiesQuery(dialect, 0, "4", "1", "10"),
+	}
+
+	clauses := map[string]*regexp.Regexp{
+		"GROUP_CONCAT":        regexp.MustCompile(`(?i)\bGROUP_CONCAT\b|\bSEPARATOR\b`),
+		"backtick":            regexp.MustCompile("`"),
+		"derived table of IN": regexp.MustCompile(`(?i)SELECT \* FROM \(`),
+		"unquoted camel case": regexp.MustCompile(`[.\s](admin1CodesAscii|isoLanguage|alternateName|isPreferredName|isShortName)\b`),
+	}
+
+	// name is a keyword before PostgreSQL 14, it can't be an alias without AS
+	alias := regexp.MustCompile(`(?i)(\S+)\s+name\s*,`)
+
+	for name, query := range queries {
+		for clause, expression := range clauses {
+			if match := expression.FindString(query); match != "" {
+				t.Errorf("postgres %s query contains %s: %q", name, clause, match)
+			}
+		}
+
+		for _, match := range alias.FindAllStringSubmatch(query, -1) {
+			if strings.ToUpper(match[1]) != "AS" {
+				t.Errorf("postgres %s query has alias name without AS: %q", name, match[0])
+			}
+		}
+	}
+}
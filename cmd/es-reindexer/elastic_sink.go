@@ -0,0 +1,228 @@
+// Copyright 2016-present InterPals. All Rights Reserved.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	esreindexer "github.com/interpals/es-reindexer"
+	"github.com/olivere/elastic"
+)
+
+// Sink which indexes records by Elasticsearch bulk API
+type elasticSink struct {
+	client *elastic.Client
+
+	// Replaces index of records, for example alias by its new generation
+	indices map[string]string
+
+	format documentFormat
+}
+
+func newElasticSink(client *elastic.Client, indices map[string]string, format documentFormat) *elasticSink {
+	return &elasticSink{
+		client:  client,
+		indices: indices,
+		format:  format,
+	}
+}
+
+func (this *elasticSink) index(record esreindexer.FetchedRecord) string {
+	if index, ok := this.indices[record.GetIndex()]; ok {
+		return index
+	}
+
+	return record.GetIndex()
+}
+
+// Bulk request of typeless cluster. The client writes routing as _routing, which Elasticsearch 7 and OpenSearch
+// don't accept, so the action line is built here.
+type typelessBulkRequest struct {
+	// "index" or "delete"
+	action string
+
+	meta typelessBulkMeta
+	doc  interface{}
+}
+
+type typelessBulkMeta struct {
+	Index   string `json:"_index"`
+	Id      string `json:"_id"`
+	Routing string `json:"routing,omitempty"`
+}
+
+func (this typelessBulkRequest) Source() ([]string, error) {
+	action, err := json.Marshal(map[string]typelessBulkMeta{this.action: this.meta})
+	if err != nil {
+		return nil, err
+	}
+
+	lines := []string{string(action)}
+
+	if this.action == "delete" {
+		return lines, nil
+	}
+
+	doc, ok := this.doc.(json.RawMessage)
+	if !ok {
+		doc, err = json.Marshal(this.doc)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return append(lines, string(doc)), nil
+}
+
+func (this typelessBulkRequest) String() string {
+	lines, err := this.Source()
+	if err != nil {
+		return fmt.Sprintf("error: %v", err)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func (this *elasticSink) newTypelessBulkRequest(record esreindexer.FetchedRecord) typelessBulkRequest {
+	request := typelessBulkRequest{
+		action: "index",
+		meta: typelessBulkMeta{
+			Index:   this.index(record),
+			Id:      strconv.FormatUint(record.GetId(), 10),
+			Routing: this.format.routing(record),
+		},
+	}
+
+	if esreindexer.IsDeleted(record) {
+		request.action = "delete"
+	} else {
+		request.doc = this.format.document(record)
+	}
+
+	return request
+}
+
+func (this *elasticSink) newBulkIndexRequest(record esreindexer.FetchedRecord) *elastic.BulkIndexRequest {
+	request := elastic.NewBulkIndexRequest().
+		Index(this.index(record)).
+		Type(record.GetType()).
+		Id(strconv.FormatUint(record.GetId(), 10)).
+		Doc(record.GetSearchData())
+
+	parent := record.GetParent()
+	if parent != nil {
+		request.Parent(strconv.FormatUint(*parent, 10))
+	}
+
+	return request
+}
+
+func (this *elasticSink) newBulkDeleteRequest(record esreindexer.FetchedRecord) *elastic.BulkDeleteRequest {
+	request := elastic.NewBulkDeleteRequest().
+		Index(this.index(record)).
+		Type(record.GetType()).
+		Id(strconv.FormatUint(record.GetId(), 10))
+
+	parent := record.GetParent()
+	if parent != nil {
+		request.Parent(strconv.FormatUint(*parent, 10))
+	}
+
+	return request
+}
+
+func (this *elasticSink) newBulkRequest(record esreindexer.FetchedRecord) elastic.BulkableRequest {
+	if this.format.typeless {
+		return this.newTypelessBulkRequest(record)
+	}
+
+	if esreindexer.IsDeleted(record) {
+		return this.newBulkDeleteRequest(record)
+	}
+
+	return this.newBulkIndexRequest(record)
+}
+
+func (this *elasticSink) Write(ctx context.Context, records []esreindexer.FetchedRecord) ([]SinkItemResult, error) {
+	bulkRequest := this.client.Bulk()
+
+	for _, record := range records {
+		bulkRequest.Add(this.newBulkRequest(record))
+	}
+
+	response, err := bulkRequest.Do(ctx)
+	if err != nil {
+		if !isRetryableElasticError(err) {
+			return nil, permanent(err)
+		}
+
+		return nil, err
+	}
+
+	return bulkResponseResults(records, response), nil
+}
+
+// Connection errors, timeouts, throttling and server side errors are worth to retry
+func isRetryableElasticError(err error) bool {
+	if elasticErr, ok := err.(*elastic.Error); ok {
+		return elasticErr.Status == http.StatusRequestTimeout ||
+			elasticErr.Status == http.StatusTooManyRequests ||
+			elasticErr.Status >= http.StatusInternalServerError
+	}
+
+	return true
+}
+
+// Cluster is overloaded and rejects requests
+func isThrottlingError(err error) bool {
+	if elasticErr, ok := err.(*elastic.Error); ok {
+		return elasticErr.Status == http.StatusTooManyRequests ||
+			(elasticErr.Details != nil && elasticErr.Details.Type == "es_rejected_execution_exception")
+	}
+
+	return false
+}
+
+// Bulk API returns items in the same order as requests were sent
+func bulkResponseResults(records []esreindexer.FetchedRecord, response *elastic.BulkResponse) []SinkItemResult {
+	results := make([]SinkItemResult, len(records))
+
+	for i, record := range records {
+		results[i].Record = record
+
+		if i >= len(response.Items) {
+			results[i].ErrorType = "missing_item"
+			results[i].Error = "missing item in bulk response"
+			continue
+		}
+
+		for _, item := range response.Items[i] {
+			results[i].Status = item.Status
+
+			// Document which is deleted doesn't exist already, that's fine
+			if item.Status == http.StatusNotFound && esreindexer.IsDeleted(record) {
+				continue
+			}
+
+			if item.Error != nil {
+				results[i].ErrorType = item.Error.Type
+				results[i].Error = item.Error.Reason
+			}
+		}
+	}
+
+	return results
+}
+
+func (this *elasticSink) Flush() error {
+	return nil
+}
+
+func (this *elasticSink) Close() error {
+	return nil
+}
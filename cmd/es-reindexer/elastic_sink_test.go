@@ -0,0 +1,47 @@
+// Copyright 2016-present InterPals. All Rights Reserved.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	esreindexer "github.com/interpals/es-reindexer"
+)
+
+func TestTypelessBulkActionLine(t *testing.T) {
+	sink := newElasticSink(nil, map[string]string{"geo": "geo_20170101000000"}, newGeoFormat(true))
+	regionId := uint64(1)
+
+	lines, err := sink.newBulkRequest(newGeoRecord("city", 2, &regionId)).Source()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(lines) != 2 {
+		t.Fatalf("expected action and document lines, got %v", lines)
+	}
+
+	expected := `{"index":{"_index":"geo_20170101000000","_id":"2","routing":"1"}}`
+	if lines[0] != expected {
+		t.Errorf("expected action line %s, got %s", expected, lines[0])
+	}
+
+	if strings.Contains(lines[0], `"_routing"`) || strings.Contains(lines[0], `"_type"`) {
+		t.Errorf("action line must not contain _routing and _type: %s", lines[0])
+	}
+
+	if !strings.Contains(lines[1], `"relation":{"name":"city","parent":"1"}`) {
+		t.Errorf("document line doesn't contain the join field: %s", lines[1])
+	}
+
+	lines, err = sink.newBulkRequest(esreindexer.NewDeletedRecord("geo", "region", 1)).Source()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected = `{"delete":{"_index":"geo_20170101000000","_id":"1"}}`
+	if len(lines) != 1 || lines[0] != expected {
+		t.Errorf("expected delete action %s, got %v", expected, lines)
+	}
+}
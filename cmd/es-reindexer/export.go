@@ -0,0 +1,290 @@
+// Copyright 2016-present InterPals. All Rights Reserved.
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	esreindexer "github.com/interpals/es-reindexer"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+)
+
+// Export file of the partition, records are RawRecord objects, one per line
+func exportPath(dir string, model string, threadNumber uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%s-%03d.ndjson.gz", model, threadNumber))
+}
+
+// Export files of the model left by previous export, it could have more partitions than the current one
+func removeExportFiles(dir string, model string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, model+"-[0-9]*.ndjson.gz"))
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Writes records of the channel into gzipped NDJSON file, the file appears under its name only when
+// all records are written, so import never reads an unfinished export.
+// Fetch is cancelled on write error.
+func writeExportFile(path string, channel chan esreindexer.FetchedRecord, cancel context.CancelFunc) (uint64, error) {
+	tmpPath := path + ".tmp"
+
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return 0, err
+	}
+
+	defer os.Remove(tmpPath)
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	compressor := gzip.NewWriter(writer)
+	encoder := json.NewEncoder(compressor)
+
+	var count uint64
+
+	for record := range channel {
+		raw, err := esreindexer.NewRawRecord(record)
+		if err == nil {
+			err = encoder.Encode(raw)
+		}
+
+		if err != nil {
+			cancel()
+
+			// Fetch goroutine waits for the channel until it sees cancellation
+			for range channel {
+			}
+
+			return count, err
+		}
+
+		count++
+	}
+
+	err = compressor.Close()
+	if err == nil {
+		err = writer.Flush()
+	}
+
+	if err == nil {
+		err = file.Close()
+	}
+
+	if err != nil {
+		return count, err
+	}
+
+	return count, os.Rename(tmpPath, path)
+}
+
+// Fetches all records of the source like full reindex does, every partition is written into its own file
+func exportModel(
+	ctx context.Context,
+	db *gorm.DB,
+	dir string,
+	configuration esreindexer.DataBaseConfig,
+	source Source) error {
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	// Import reads all files of the directory, so stale partitions must not stay next to new ones
+	err = removeExportFiles(dir, source.Name())
+	if err != nil {
+		return err
+	}
+
+	threads := uint64(configuration.Threads)
+	errs := make([]error, threads)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg *sync.WaitGroup = new(sync.WaitGroup)
+
+	for i := uint64(0); i < threads; i++ {
+		wg.Add(1)
+
+		go func(threadNumber uint64) {
+			defer wg.Done()
+
+			channel := make(chan esreindexer.FetchedRecord, configuration.Limit)
+			path := exportPath(dir, source.Name(), threadNumber)
+
+			partitionLog := loggerFromContext(ctx).WithField("partition", threadNumber)
+			ctx := withLogger(ctx, partitionLog)
+
+			var fetchErr error
+
+			go func() {
+				// There is nothing to resume, so there are no checkpoints
+				fetchErr = source.Fetch(ctx, db.New(), channel, nil, threads, threadNumber, configuration)
+				close(channel)
+			}()
+
+			count, err := writeExportFile(path, channel, cancel)
+			if err == nil {
+				err = fetchErr
+			}
+
+			if err == nil && ctx.Err() != nil {
+				err = errInterrupted
+			}
+
+			if err != nil {
+				partitionLog.WithError(err).Error("Export of partition failed")
+				errs[threadNumber] = err
+				cancel()
+				return
+			}
+
+			partitionLog.WithFields(logrus.Fields{"count": count, "path": path}).Info("Exported partition")
+		}(i)
+	}
+
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil && err != errInterrupted {
+			return err
+		}
+	}
+
+	if ctx.Err() != nil {
+		return errInterrupted
+	}
+
+	loggerFromContext(ctx).WithFields(logrus.Fields{"count": runCountersFromContext(ctx).Fetched(), "dir": dir}).Info("Export finished")
+
+	return nil
+}
+
+func runExport(ctx context.Context, dbs *databases, config esreindexer.Configuration, model string, dir string) error {
+	source, ok := lookupSource(model)
+	if !ok || dir == "" {
+		return fmt.Errorf("Usage: es-reindexer export <model> <dir>")
+	}
+
+	ctx = withLogger(ctx, loggerFromContext(ctx).WithFields(logrus.Fields{"component": "export", "model": source.Name()}))
+
+	err := source.Validate(config)
+	if err != nil {
+		return err
+	}
+
+	fetchCtx, err := newFetchContext(ctx, config, source)
+	if err != nil {
+		return err
+	}
+
+	db, err := dbs.Get(source.DataBaseUriKey())
+	if err != nil {
+		return err
+	}
+
+	return exportModel(fetchCtx, db, dir, config.DataBase, source)
+}
+
+// Export files of the directory, in order of names
+func exportFiles(dir string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.ndjson.gz"))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("there are no *.ndjson.gz files in %s", dir)
+	}
+
+	sort.Strings(paths)
+
+	return paths, nil
+}
+
+func readExportFile(ctx context.Context, path string, channel chan esreindexer.FetchedRecord) (uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+
+	defer file.Close()
+
+	decompressor, err := gzip.NewReader(bufio.NewReader(file))
+	if err != nil {
+		return 0, err
+	}
+
+	defer decompressor.Close()
+
+	var count uint64
+
+	decoder := json.NewDecoder(decompressor)
+	for decoder.More() {
+		var record esreindexer.RawRecord
+
+		err := decoder.Decode(&record)
+		if err != nil {
+			return count, fmt.Errorf("%s: %s", path, err)
+		}
+
+		if !sendRecord(ctx, channel, record) {
+			return count, nil
+		}
+
+		count++
+		countFetched(ctx, 1)
+	}
+
+	return count, nil
+}
+
+// Reads export files of the directory, one goroutine per file, and sends their records to the channel
+func startImport(
+	ctx context.Context,
+	fatal *fatalError,
+	paths []string,
+	channel chan esreindexer.FetchedRecord) {
+
+	var wg *sync.WaitGroup = new(sync.WaitGroup)
+
+	for _, path := range paths {
+		wg.Add(1)
+
+		go func(path string) {
+			defer wg.Done()
+
+			count, err := readExportFile(ctx, path, channel)
+			if err != nil {
+				loggerFromContext(ctx).WithField("path", path).WithError(err).Error("Import failed")
+				fatal.Report(err)
+				return
+			}
+
+			loggerFromContext(ctx).WithFields(logrus.Fields{"count": count, "path": path}).Info("Imported file")
+		}(path)
+	}
+
+	wg.Wait()
+
+	close(channel)
+}
@@ -0,0 +1,90 @@
+// Copyright 2016-present InterPals. All Rights Reserved.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	esreindexer "github.com/interpals/es-reindexer"
+)
+
+func TestRemoveExportFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "es-reindexer")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	stale := []string{exportPath(dir, "users", 0), exportPath(dir, "users", 7)}
+	kept := []string{exportPath(dir, "geo", 0), filepath.Join(dir, "users-backup.ndjson.gz")}
+
+	for _, path := range append(stale, kept...) {
+		err = ioutil.WriteFile(path, nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = removeExportFiles(dir, "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range stale {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s must be removed", path)
+		}
+	}
+
+	for _, path := range kept {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s must be kept: %s", path, err)
+		}
+	}
+}
+
+func TestWriteExportFileCancelsFetchOnError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "es-reindexer")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	channel := make(chan esreindexer.FetchedRecord)
+
+	// Fetch stops only when it sees cancellation
+	go func() {
+		defer close(channel)
+
+		for id := uint64(1); ; id++ {
+			var record esreindexer.FetchedRecord = newTestRecord(id, 10)
+			if id == 2 {
+				record = unmarshallableRecord{newTestRecord(id, 10)}
+			}
+
+			if !sendRecord(ctx, channel, record) {
+				return
+			}
+		}
+	}()
+
+	path := exportPath(dir, "users", 0)
+
+	count, err := writeExportFile(path, channel, cancel)
+	if err == nil || count != 1 {
+		t.Errorf("expected error after 1 record, got %d records and %v", count, err)
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("failed export must not leave the file")
+	}
+}
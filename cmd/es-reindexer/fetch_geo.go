@@ -1,20 +1,233 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"github.com/jinzhu/gorm"
 	"github.com/interpals/es-reindexer"
-	"sync"
 	"strconv"
-	"log"
 )
 
+// Camel case names of geonames tables and columns, quoted for the dialect
+type geoIdentifiers struct {
+	admin1CodesAscii string
+	isoLanguage      string
+	alternateName    string
+	isPreferredName  string
+	isShortName      string
+}
+
+func newGeoIdentifiers(dialect sqlDialect) geoIdentifiers {
+	return geoIdentifiers{
+		admin1CodesAscii: dialect.Identifier(`admin1CodesAscii`),
+		isoLanguage:      dialect.Identifier(`isoLanguage`),
+		alternateName:    dialect.Identifier(`alternateName`),
+		isPreferredName:  dialect.Identifier(`isPreferredName`),
+		isShortName:      dialect.Identifier(`isShortName`),
+	}
+}
+
+// Names of countries in all languages, short and preferred names first
+func createSelectCountriesQuery(dialect sqlDialect) string {
+	quoted := newGeoIdentifiers(dialect)
+
+	return `
+	SELECT
+	a.`+quoted.isoLanguage+` lang,
+    a.`+quoted.alternateName+` AS name,
+	g.geonameid,
+	g.country,
+	g.population,
+	g.latitude,
+	g.longitude,
+	g.timezone
+	FROM geoname g
+	JOIN alternatename a
+	ON a.geonameid = g.geonameid
+WHERE (g.fcode LIKE 'PCL%' OR g.fcode='TERR') AND
+		a.`+quoted.isoLanguage+` NOT IN('link')
+	ORDER BY
+		g.geonameid asc,
+	    `+dialect.Desc(`a.`+quoted.isShortName)+`,
+		`+dialect.Desc(`a.`+quoted.isPreferredName)+`
+	`
+}
+
+// Page of regions of the partition with their names in all languages
+func createSelectRegionsQuery(dialect sqlDialect, lastId uint64, threadsCount string, threadId string, limit string) string {
+	quoted := newGeoIdentifiers(dialect)
+
+	return `
+SELECT
+    ac.geonameid geonameid,
+    g.asciiname asciiname,
+	g.name AS name,
+    a.`+quoted.isoLanguage+` lang,
+    a.`+quoted.alternateName+` altname,
+	g.population population,
+	g.timezone timezone,
+	g.latitude latitude,
+	g.longitude longitude,
+	g.country country
+FROM `+quoted.admin1CodesAscii+` ac
+LEFT JOIN geoname g ON
+	g.geonameid = ac.geonameid
+LEFT OUTER JOIN alternatename a ON
+    ac.geonameid = a.geonameid AND
+	a.`+quoted.isoLanguage+` NOT IN ('link', 'iata', 'post', 'icao', 'faac', 'fr_1793')
+WHERE
+	ac.geonameid IN
+		(` + dialect.LimitedSubquery(`
+			SELECT geonameid
+			FROM `+quoted.admin1CodesAscii+` ac
+			WHERE ac.geonameid > `+strconv.FormatUint(lastId, 10)+` AND
+				  ac.geonameid % `+threadsCount+` = `+threadId+`
+		    ORDER BY geonameid ASC
+			LIMIT `+limit) + `
+	    )
+ORDER BY
+    ac.geonameid ASC,
+	` + dialect.Asc(`a.`+quoted.isoLanguage) + `,
+    ` + dialect.Desc(`a.`+quoted.isPreferredName) + `,
+    ` + dialect.Desc(`a.`+quoted.isShortName) + `
+`
+}
+
+// Page of cities of the partition with names of their regions in the same languages
+func createSelectCitiesQuery(dialect sqlDialect, lastId uint64, threadsCount string, threadId string, limit string) string {
+	quoted := newGeoIdentifiers(dialect)
+
+	return `
+SELECT
+	g.geonameid geonameid,
+	g.asciiname cityasciiname,
+	g.name cityname,
+	g.population population,
+	g.timezone timezone,
+	g.latitude latitude,
+	g.longitude longitude,
+	g.country country,
+	a_city.`+quoted.isoLanguage+` lang,
+	a_city.`+quoted.alternateName+` cityalt,
+	g_reg.asciiname regasciiname,
+	g_reg.name regname,
+	a_reg.`+quoted.alternateName+` regalt,
+	g_reg.geonameid regid
+FROM geoname g
+LEFT OUTER JOIN alternatename a_city ON
+	g.geonameid = a_city.geonameid AND
+	a_city.`+quoted.isoLanguage+` NOT IN ('link', 'iata', 'post', 'icao', 'faac', 'fr_1793')
+LEFT JOIN `+quoted.admin1CodesAscii+` ac ON
+	ac.code = CONCAT(g.country, '.', g.admin1)
+LEFT JOIN geoname g_reg ON
+	g_reg.geonameid = ac.geonameid
+LEFT OUTER JOIN alternatename a_reg ON
+	ac.geonameid = a_reg.geonameid AND
+	a_reg.`+quoted.isoLanguage+` = a_city.`+quoted.isoLanguage+` AND
+	a_city.`+quoted.isoLanguage+` NOT IN ('link', 'iata', 'post', 'icao', 'faac', 'fr_1793')
+WHERE
+	g.fclass = 'P' AND
+	g.geonameid IN
+		(` + dialect.LimitedSubquery(`
+			SELECT geonameid
+			FROM geoname g
+			WHERE g.geonameid > `+strconv.FormatUint(lastId, 10)+` AND
+				  g.geonameid % `+threadsCount+` = `+threadId+`
+			ORDER BY geonameid ASC
+			LIMIT `+limit) + `
+		)
+ORDER BY
+	geonameid ASC,
+	` + dialect.Asc(`a_city.`+quoted.isoLanguage) + `,
+	` + dialect.Desc(`a_city.`+quoted.isPreferredName) + `,
+	` + dialect.Desc(`a_city.`+quoted.isShortName) + `,
+	` + dialect.Desc(`a_reg.`+quoted.isPreferredName) + `,
+	` + dialect.Desc(`a_reg.`+quoted.isShortName) + `
+`
+}
+
+type geoSource struct{}
+
+func init() {
+	registerSource(geoSource{})
+}
+
+func (geoSource) Name() string {
+	return "geo"
+}
+
+func (geoSource) Index() string {
+	return esreindexer.GNItem{}.GetIndex()
+}
+
+func (geoSource) DataBaseUriKey() string {
+	return "uri-geo"
+}
+
+func (this geoSource) Validate(configuration esreindexer.Configuration) error {
+	return validateSourceConfiguration(this, configuration)
+}
+
+func (geoSource) Fetch(
+	ctx context.Context,
+	db *gorm.DB,
+	channel chan esreindexer.FetchedRecord,
+	checkpoints *checkpointTracker,
+	numberOfThread uint64,
+	threadNumber uint64,
+	configuration esreindexer.DataBaseConfig) error {
+
+	return fetchGeo(ctx, db, channel, checkpoints, numberOfThread, threadNumber, configuration)
+}
+
+func (geoSource) Count(
+	ctx context.Context,
+	db *gorm.DB,
+	checkpoints *checkpointTracker,
+	numberOfThread uint64,
+	threadNumber uint64,
+	configuration esreindexer.DataBaseConfig) (map[string]uint64, error) {
+
+	var (
+		threadsCount = strconv.FormatUint(numberOfThread, 10)
+		threadId     = strconv.FormatUint(threadNumber, 10)
+		regions      = partitionKey("regions", threadNumber)
+		cities       = partitionKey("cities", threadNumber)
+		quoted       = newGeoIdentifiers(newSqlDialect(configuration))
+	)
+
+	regionsCount, err := queryCount(ctx, db, configuration, `
+SELECT COUNT(*)
+FROM `+quoted.admin1CodesAscii+` ac
+WHERE ac.geonameid > `+strconv.FormatUint(checkpoints.LastId(regions), 10)+` AND
+	  ac.geonameid % `+threadsCount+` = `+threadId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	citiesCount, err := queryCount(ctx, db, configuration, `
+SELECT COUNT(*)
+FROM geoname g
+WHERE g.fclass = 'P' AND
+	  g.geonameid > `+strconv.FormatUint(checkpoints.LastId(cities), 10)+` AND
+	  g.geonameid % `+threadsCount+` = `+threadId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]uint64{regions: regionsCount, cities: citiesCount}, nil
+}
+
 func fetchGeo(
+	ctx context.Context,
 	db *gorm.DB,
 	channel chan esreindexer.FetchedRecord,
-	wg *sync.WaitGroup,
+	checkpoints *checkpointTracker,
 	numberOfThread uint64,
 	threadNumber uint64,
-	configuration esreindexer.DataBaseConfig) {
+	configuration esreindexer.DataBaseConfig) error {
 
 	var (
 		threadsCount = strconv.FormatUint(numberOfThread, 10)
@@ -29,62 +242,67 @@ func fetchGeo(
 		esIndex = true
 	}
 
-	countries := fetchCountries(db, channel, esIndex)
-	fetchRegions(db, channel, threadsCount, threadId, limit, countries)
-	fetchCities(db, channel, threadsCount, threadId, limit, countries)
+	countries, err := fetchCountries(ctx, db, channel, esIndex, configuration)
+	if err != nil {
+		return err
+	}
+
+	// Countries are always fetched again, regions and cities have own checkpoints
+	err = fetchRegions(
+		ctx, db, channel, checkpoints, partitionKey("regions", threadNumber),
+		threadsCount, threadId, limit, countries, configuration)
+
+	if err != nil {
+		return err
+	}
 
-	wg.Done()
-	log.Print("Finished fetch goroutine ", threadNumber)
+	return fetchCities(
+		ctx, db, channel, checkpoints, partitionKey("cities", threadNumber),
+		threadsCount, threadId, limit, countries, configuration)
 }
 
 // Fetch countries, optionally indexing in ES (since called by every thread only one needs to do so)
 func fetchCountries(
+	ctx context.Context,
 	db *gorm.DB,
 	channel chan esreindexer.FetchedRecord,
 	esImport bool,
-) map[string]map[string]string {
+	configuration esreindexer.DataBaseConfig,
+) (map[string]map[string]string, error) {
 
 	ctryLangNameRes := map[string]map[string]string{}
 
 	var lastCount uint64 = 0
 	var country esreindexer.GNItem
+	var countryRows []esreindexer.GNCountryRow
 
-	rows, err := db.Raw(`
-	SELECT
-	a.isoLanguage lang,
-    a.alternatename name,
-	g.geonameid,
-	g.country,
-	g.population,
-	g.latitude,
-	g.longitude,
-	g.timezone
-	FROM geoname g
-	JOIN alternatename a
-	ON a.geonameid = g.geonameid
-WHERE (g.fcode LIKE 'PCL%' OR g.fcode="TERR") AND
-		a.isoLanguage NOT IN('link')
-	ORDER BY
-		g.geonameid asc,
-	    a.isShortName desc,
-		a.isPreferredName desc
-	`).Rows()
+	dialect := newSqlDialect(configuration)
 
-	if err != nil {
-		panic(err)
-	}
+	err := queryPage(ctx, db, configuration, createSelectCountriesQuery(dialect), func(rows *sql.Rows) (int, error) {
+		countryRows = countryRows[:0]
 
-	for rows.Next() {
-		var row esreindexer.GNCountryRow
-		err := db.ScanRows(rows, &row)
+		for rows.Next() {
+			var row esreindexer.GNCountryRow
 
-		if err != nil {
-			panic(err)
+			err := db.ScanRows(rows, &row)
+			if err != nil {
+				return 0, err
+			}
+
+			countryRows = append(countryRows, row)
 		}
 
+		return len(countryRows), nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range countryRows {
 		if country.Geonameid != row.Geonameid {
-			if esImport && lastCount > 0 {
-				channel <- country
+			if esImport && lastCount > 0 && !sendRecord(ctx, channel, country) {
+				return ctryLangNameRes, nil
 			}
 
 			country = esreindexer.GNItem{
@@ -115,85 +333,66 @@ WHERE (g.fcode LIKE 'PCL%' OR g.fcode="TERR") AND
 		}
 	}
 
-	if esImport && lastCount > 0 {
-		channel <- country
-		totalFetch.Add(lastCount)
+	if esImport && lastCount > 0 && sendRecord(ctx, channel, country) {
+		countFetched(ctx, lastCount)
+		observeFetch(ctx, "countries", int(lastCount))
 	}
 
-	rows.Close()
-
-	return ctryLangNameRes
+	return ctryLangNameRes, nil
 }
 
 func fetchRegions(
+	ctx context.Context,
 	db *gorm.DB,
 	channel chan esreindexer.FetchedRecord,
+	checkpoints *checkpointTracker,
+	partition string,
 	threadsCount string,
 	threadId string,
 	limit string,
 	countries map[string]map[string]string,
-) {
+	configuration esreindexer.DataBaseConfig,
+) error {
 	var (
-		region esreindexer.GNItem
-		row    esreindexer.GNRegionRow
+		region     esreindexer.GNItem
+		row        esreindexer.GNRegionRow
+		regionRows []esreindexer.GNRegionRow
 
-		lastId    uint64 = 0
+		lastId    = checkpoints.LastId(partition)
 		lastCount uint64
+
+		dialect = newSqlDialect(configuration)
 	)
 
-	for {
+	for ctx.Err() == nil {
 		lastCount = 0
+		page := []esreindexer.FetchedRecord{}
 
-		rows, err := db.Raw(`
-SELECT
-    ac.geonameid geonameid,
-    g.asciiname asciiname,
-	g.name name,
-    a.isoLanguage lang,
-    a.alternateName altname,
-	g.population population,
-	g.timezone timezone,
-	g.latitude latitude,
-	g.longitude longitude,
-	g.country country
-FROM admin1CodesAscii ac
-LEFT JOIN geoname g ON
-	g.geonameid = ac.geonameid
-LEFT OUTER JOIN alternatename a ON
-    ac.geonameid = a.geonameid AND
-	a.isoLanguage NOT IN ('link', 'iata', 'post', 'icao', 'faac', 'fr_1793')
-WHERE
-	ac.geonameid IN
-		(SELECT * FROM /* mysql is stupid and won't allow limits in IN subqueries */
-			(SELECT geonameid
-			FROM admin1CodesAscii ac
-			WHERE ac.geonameid > ` + strconv.FormatUint(lastId, 10) + ` AND
-				  ac.geonameid % ` + threadsCount + ` = ` + threadId + `
-		    ORDER BY geonameid ASC
-			LIMIT ` + limit + `)t
-	    )
-ORDER BY
-    ac.geonameid ASC,
-	a.isoLanguage ASC,
-    a.isPreferredName DESC,
-    a.isShortName DESC
-`).Rows()
+		err := queryPage(ctx, db, configuration, createSelectRegionsQuery(dialect, lastId, threadsCount, threadId, limit), func(rows *sql.Rows) (int, error) {
+			regionRows = regionRows[:0]
 
-		if err != nil {
-			panic(err)
-		}
+			for rows.Next() {
+				row := esreindexer.GNRegionRow{}
 
-		for rows.Next() {
-			row = esreindexer.GNRegionRow{}
-			err := db.ScanRows(rows, &row)
+				err := db.ScanRows(rows, &row)
+				if err != nil {
+					return 0, err
+				}
 
-			if err != nil {
-				panic(err)
+				regionRows = append(regionRows, row)
 			}
 
+			return len(regionRows), nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		for _, row = range regionRows {
 			if region.Geonameid != row.Geonameid {
 				if lastCount > 0 {
-					channel <- region
+					page = append(page, region)
 				}
 
 				// Create new region for this row
@@ -256,95 +455,70 @@ ORDER BY
 			}
 		}
 
-		channel <- region
+		page = append(page, region)
+
+		if !sendPage(ctx, channel, checkpoints, partition, lastId, page) {
+			return nil
+		}
 
-		totalFetch.Add(lastCount)
-		rows.Close()
+		countFetched(ctx, lastCount)
 	}
+
+	return nil
 }
 
 func fetchCities(
+	ctx context.Context,
 	db *gorm.DB,
 	channel chan esreindexer.FetchedRecord,
+	checkpoints *checkpointTracker,
+	partition string,
 	threadsCount string,
 	threadId string,
 	limit string,
 	countries map[string]map[string]string,
-) {
+	configuration esreindexer.DataBaseConfig,
+) error {
 	var (
-		city esreindexer.GNItem
-		row  esreindexer.GNCityRow
+		city     esreindexer.GNItem
+		row      esreindexer.GNCityRow
+		cityRows []esreindexer.GNCityRow
 
-		lastId    uint64 = 0
+		lastId    = checkpoints.LastId(partition)
 		lastCount uint64
+
+		dialect = newSqlDialect(configuration)
 	)
 
-	for {
+	for ctx.Err() == nil {
 		lastCount = 0
+		page := []esreindexer.FetchedRecord{}
 
-		rows, err := db.Raw(`
-SELECT
-	g.geonameid geonameid,
-	g.asciiname cityasciiname,
-	g.name cityname,
-	g.population population,
-	g.timezone timezone,
-	g.latitude latitude,
-	g.longitude longitude,
-	g.country country,
-	a_city.isoLanguage lang,
-	a_city.alternateName cityalt,
-	g_reg.asciiname regasciiname,
-	g_reg.name regname,
-	a_reg.alternateName regalt,
-	g_reg.geonameid regid
-FROM geoname g
-LEFT OUTER JOIN alternatename a_city ON
-	g.geonameid = a_city.geonameid AND
-	a_city.isoLanguage NOT IN ('link', 'iata', 'post', 'icao', 'faac', 'fr_1793')
-LEFT JOIN admin1CodesAscii ac ON
-	ac.code = CONCAT(g.country, '.', g.admin1)
-LEFT JOIN geoname g_reg ON
-	g_reg.geonameid = ac.geonameid
-LEFT OUTER JOIN alternatename a_reg ON
-	ac.geonameid = a_reg.geonameid AND
-	a_reg.isoLanguage = a_city.isoLanguage AND
-	a_city.isoLanguage NOT IN ('link', 'iata', 'post', 'icao', 'faac', 'fr_1793')
-WHERE
-	g.fclass = 'P' AND
-	g.geonameid IN
-		(SELECT * FROM /* mysql is stupid and won't allow limits in IN subqueries */
-			(SELECT geonameid
-			FROM geoname g
-			WHERE g.geonameid > ` + strconv.FormatUint(lastId, 10) + ` AND
-				  g.geonameid % ` + threadsCount + ` = ` + threadId + `
-			ORDER BY geonameid ASC
-			LIMIT ` + limit + `)t
-		)
-ORDER BY
-	geonameid ASC,
-	a_city.isoLanguage ASC,
-	a_city.isPreferredName DESC,
-	a_city.isShortName DESC,
-	a_reg.isPreferredName DESC,
-	a_reg.isShortName DESC
-`).Rows()
+		err := queryPage(ctx, db, configuration, createSelectCitiesQuery(dialect, lastId, threadsCount, threadId, limit), func(rows *sql.Rows) (int, error) {
+			cityRows = cityRows[:0]
 
-		if err != nil {
-			panic(err)
-		}
+			for rows.Next() {
+				row := esreindexer.GNCityRow{}
 
-		for rows.Next() {
-			row = esreindexer.GNCityRow{}
-			err := db.ScanRows(rows, &row)
+				err := db.ScanRows(rows, &row)
+				if err != nil {
+					return 0, err
+				}
 
-			if err != nil {
-				panic(err)
+				cityRows = append(cityRows, row)
 			}
 
+			return len(cityRows), nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		for _, row = range cityRows {
 			if city.Geonameid != row.Geonameid {
 				if lastCount > 0 {
-					channel <- city
+					page = append(page, city)
 				}
 
 				// Create new city for this row
@@ -430,9 +604,14 @@ ORDER BY
 			}
 		}
 
-		channel <- city
+		page = append(page, city)
 
-		totalFetch.Add(lastCount)
-		rows.Close()
+		if !sendPage(ctx, channel, checkpoints, partition, lastId, page) {
+			return nil
+		}
+
+		countFetched(ctx, lastCount)
 	}
+
+	return nil
 }
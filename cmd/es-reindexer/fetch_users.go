@@ -1,22 +1,34 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"github.com/jinzhu/gorm"
 	"github.com/interpals/es-reindexer"
-	"sync"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/sirupsen/logrus"
 	"strconv"
-	"log"
+	"strings"
+	"time"
 )
 
-func createSelectUsersQuery(order string, limit string, condition string) string {
+// Users which are indexed, the rest must be deleted from the index
+func searchableUsersCondition(dialect sqlDialect) string {
+	return dialect.IsTrue(`u.activated`) + ` AND ` + dialect.IsTrue(`u.searchable`)
+}
+
+func createSelectUsersQuery(dialect sqlDialect, order string, limit string, condition string) string {
 	return `
 	SELECT
 		u.id,
+		u.activated,
+		u.searchable,
 		u.name,
 		u.username,
-		u.last_login,
-		u.signup,
-		u.modified,
+		` + dialect.DateTime(`u.last_login`, `last_login`) + `,
+		` + dialect.DateTime(`u.signup`, `signup`) + `,
+		` + dialect.DateTime(`u.modified`, `modified`) + `,
 		u.sex,
 		u.tz,
 		u.city,
@@ -29,7 +41,7 @@ func createSelectUsersQuery(order string, limit string, condition string) string
 		u.main_thumb,
 		u.cont,
 		u.age,
-		u.birth,
+		` + dialect.Date(`u.birth`, `birth`) + `,
 		u.lfor_friend,
 		u.lfor_langex,
 		u.lfor_relation,
@@ -48,9 +60,9 @@ func createSelectUsersQuery(order string, limit string, condition string) string
 		u.education_desc,
 		u.occupation,
 		u.relationship,
-		(SELECT GROUP_CONCAT(CONCAT_WS('|', known.lang, known.level) SEPARATOR ',')
+		(SELECT ` + dialect.GroupConcat(`CONCAT_WS('|', known.lang, known.level)`, `,`) + `
 		FROM user_langs known WHERE known.user_id = u.id) as knowninfo,
-		(SELECT GROUP_CONCAT(CONCAT_WS('|', learn.lang, learn.level) SEPARATOR ',')
+		(SELECT ` + dialect.GroupConcat(`CONCAT_WS('|', learn.lang, learn.level)`, `,`) + `
 		FROM user_langs_learn learn WHERE learn.user_id = u.id) as learninfo,
 
 		u.city_name_en,
@@ -66,65 +78,580 @@ func createSelectUsersQuery(order string, limit string, condition string) string
 	FROM users u
 	LEFT JOIN profiles_text pt ON u.id = pt.id
 	WHERE ` + condition + `
-	activated = 1
-	AND searchable = 1
 	ORDER BY ` + order + `
 	LIMIT ` + limit
 }
 
-func fetchUsers(
+type usersSource struct{}
+
+func init() {
+	registerSource(usersSource{})
+}
+
+func (usersSource) Name() string {
+	return "users"
+}
+
+func (usersSource) Index() string {
+	return esreindexer.User{}.GetIndex()
+}
+
+func (usersSource) DataBaseUriKey() string {
+	return "uri"
+}
+
+func (this usersSource) Validate(configuration esreindexer.Configuration) error {
+	return validateSourceConfiguration(this, configuration)
+}
+
+func (usersSource) ValidateDelta(field string, maxTotalFetch uint64) error {
+	if field != "signup" && field != "last_login" && field != "modified" {
+		return errors.New("Sort field must be [signup, last_login, modified]")
+	}
+
+	if maxTotalFetch < 100 || maxTotalFetch > 100000 {
+		return errors.New("Total must be 100 < x < 100k")
+	}
+
+	return nil
+}
+
+func (usersSource) Fetch(
+	ctx context.Context,
 	db *gorm.DB,
-	users chan esreindexer.FetchedRecord,
-	wg *sync.WaitGroup,
+	channel chan esreindexer.FetchedRecord,
+	checkpoints *checkpointTracker,
 	numberOfThread uint64,
 	threadNumber uint64,
-	configuration esreindexer.DataBaseConfig) {
+	configuration esreindexer.DataBaseConfig) error {
+
+	return fetchUsers(ctx, db, channel, checkpoints, numberOfThread, threadNumber, configuration)
+}
+
+func (usersSource) Count(
+	ctx context.Context,
+	db *gorm.DB,
+	checkpoints *checkpointTracker,
+	numberOfThread uint64,
+	threadNumber uint64,
+	configuration esreindexer.DataBaseConfig) (map[string]uint64, error) {
+
+	var (
+		threadsCount = strconv.FormatUint(numberOfThread, 10)
+		threadId     = strconv.FormatUint(threadNumber, 10)
+		partition    = partitionKey("", threadNumber)
+	)
+
+	count, err := queryCount(ctx, db, configuration, `
+	SELECT COUNT(*)
+	FROM users u
+	WHERE `+usersPartitionCondition(newSqlDialect(configuration), checkpoints.LastId(partition), threadsCount, threadId))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]uint64{partition: count}, nil
+}
+
+func (usersSource) FetchDelta(
+	ctx context.Context,
+	db *gorm.DB,
+	channel chan esreindexer.FetchedRecord,
+	checkpoints *checkpointTracker,
+	configuration esreindexer.DataBaseConfig,
+	field string,
+	maxTotalFetch uint64) error {
+
+	return fetchUsersDelta(ctx, db, channel, checkpoints, configuration, field, maxTotalFetch)
+}
+
+func (usersSource) Stream(
+	ctx context.Context,
+	db *gorm.DB,
+	channel chan esreindexer.FetchedRecord,
+	checkpoints *checkpointTracker,
+	configuration esreindexer.DataBaseConfig) error {
+
+	return streamUsers(ctx, db, channel, checkpoints, configuration)
+}
+
+func (usersSource) FetchIds(
+	ctx context.Context,
+	db *gorm.DB,
+	numberOfThread uint64,
+	threadNumber uint64,
+	configuration esreindexer.DataBaseConfig,
+	page func(ids []uint64) error) error {
 
 	var (
 		threadsCount = strconv.FormatUint(numberOfThread, 10)
 		threadId     = strconv.FormatUint(threadNumber, 10)
 		limit        = strconv.FormatUint(uint64(configuration.Limit), 10)
 
-		lastId    uint64 = 0
-		lastCount uint64
+		lastId uint64 = 0
 	)
 
-	for {
-		lastCount = 0
+	for ctx.Err() == nil {
+		var ids []uint64
+
+		err := queryPage(ctx, db, configuration, `
+		SELECT u.id
+		FROM users u
+		WHERE `+usersPartitionCondition(newSqlDialect(configuration), lastId, threadsCount, threadId)+`
+		ORDER BY u.id ASC
+		LIMIT `+limit, func(rows *sql.Rows) (int, error) {
+			ids = ids[:0]
+
+			for rows.Next() {
+				var id uint64
+
+				err := rows.Scan(&id)
+				if err != nil {
+					return 0, err
+				}
 
-		condition := `u.id > ` + strconv.FormatUint(lastId, 10) + ` AND u.id % ` + threadsCount + ` = ` + threadId + ` AND `
-		rows, err := db.Raw(createSelectUsersQuery("id ASC", limit, condition)).Rows()
+				ids = append(ids, id)
+			}
+
+			return len(ids), nil
+		})
 
 		if err != nil {
-			panic(err)
+			return err
 		}
 
+		if len(ids) == 0 {
+			break
+		}
+
+		lastId = ids[len(ids)-1]
+
+		err = page(ids)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (usersSource) FetchByIds(
+	ctx context.Context,
+	db *gorm.DB,
+	configuration esreindexer.DataBaseConfig,
+	ids []uint64) ([]esreindexer.FetchedRecord, error) {
+
+	return fetchUsersByIds(ctx, db, configuration, ids)
+}
+
+func (usersSource) Stale(
+	ctx context.Context,
+	db *gorm.DB,
+	configuration esreindexer.DataBaseConfig,
+	ids []uint64) ([]uint64, error) {
+
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	searchable := map[uint64]bool{}
+
+	err := queryPage(ctx, db, configuration, `
+	SELECT u.id
+	FROM users u
+	WHERE u.id IN (`+formatIds(ids)+`) AND `+searchableUsersCondition(newSqlDialect(configuration)), func(rows *sql.Rows) (int, error) {
+		count := 0
+
 		for rows.Next() {
-			lastCount++
+			var id uint64
+
+			err := rows.Scan(&id)
+			if err != nil {
+				return 0, err
+			}
+
+			searchable[id] = true
+			count++
+		}
+
+		return count, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	var stale []uint64
+	for _, id := range ids {
+		if !searchable[id] {
+			stale = append(stale, id)
+		}
+	}
+
+	return stale, nil
+}
 
+func formatIds(ids []uint64) string {
+	list := make([]string, len(ids))
+	for i, id := range ids {
+		list[i] = strconv.FormatUint(id, 10)
+	}
+
+	return strings.Join(list, ",")
+}
+
+// Users who were deactivated or hid the profile are deleted from the index
+func userRecord(user esreindexer.User) esreindexer.FetchedRecord {
+	if user.Activated && user.Searchable {
+		return user
+	}
+
+	return esreindexer.NewDeletedRecord(user.GetIndex(), user.GetType(), user.GetId())
+}
+
+// Fetches page of users, they are prepared for indexing
+func queryUsers(
+	ctx context.Context,
+	db *gorm.DB,
+	configuration esreindexer.DataBaseConfig,
+	query string,
+	args ...interface{}) ([]esreindexer.User, error) {
+
+	var users []esreindexer.User
+
+	err := queryPage(ctx, db, configuration, query, func(rows *sql.Rows) (int, error) {
+		users = users[:0]
+
+		for rows.Next() {
 			var user esreindexer.User
 
 			err := db.ScanRows(rows, &user)
 			if err != nil {
-				panic(err)
+				return 0, err
 			}
 
-			lastId = user.GetId()
 			user.Prepare()
+			users = append(users, user)
+		}
+
+		return len(users), nil
+	}, args...)
 
-			users <- user
+	return users, err
+}
+
+// Value of delta sort field, ValidateDelta allows only these fields
+func userFieldValue(user esreindexer.User, field string) string {
+	switch field {
+	case "last_login":
+		return user.Last_login
+	case "modified":
+		return user.Modified
+	}
+
+	return user.Signup
+}
+
+// Watermark for the first delta sync, it starts from the newest maxTotalFetch users.
+// Zero watermark is returned when there are less users, so all of them are fetched.
+func initialUsersWatermark(
+	ctx context.Context,
+	db *gorm.DB,
+	configuration esreindexer.DataBaseConfig,
+	field string,
+	maxTotalFetch uint64) (watermark, error) {
+
+	var mark watermark
+
+	err := queryPage(ctx, db, configuration, `
+	SELECT `+newSqlDialect(configuration).DateTime(`u.`+field, field)+`, u.id
+	FROM users u
+	ORDER BY u.`+field+` DESC, u.id DESC
+	LIMIT 1 OFFSET `+strconv.FormatUint(maxTotalFetch, 10), func(rows *sql.Rows) (int, error) {
+		count := 0
+
+		for rows.Next() {
+			err := rows.Scan(&mark.Value, &mark.Id)
+			if err != nil {
+				return 0, err
+			}
+
+			count++
+		}
+
+		return count, nil
+	})
+
+	return mark, err
+}
+
+// Fetches users changed after the watermark in ascending keyset pages (field, id).
+// Watermark is moved by checkpoints when Elasticsearch acknowledges the pages.
+func fetchUsersDelta(
+	ctx context.Context,
+	db *gorm.DB,
+	channel chan esreindexer.FetchedRecord,
+	checkpoints *checkpointTracker,
+	configuration esreindexer.DataBaseConfig,
+	field string,
+	maxTotalFetch uint64) error {
+
+	var (
+		limit = strconv.FormatUint(uint64(configuration.Limit), 10)
+		order = "u." + field + " ASC, u.id ASC"
+
+		totalCount uint64 = 0
+	)
+
+	mark := checkpoints.Watermark()
+	if mark == nil {
+		initial, err := initialUsersWatermark(ctx, db, configuration, field, maxTotalFetch)
+		if err != nil {
+			return err
+		}
+
+		loggerFromContext(ctx).WithFields(logrus.Fields{"component": "db", "field": field, "total": maxTotalFetch}).Info("There is no watermark yet, start from the newest users")
+		mark = &initial
+	}
+
+	loggerFromContext(ctx).WithFields(logrus.Fields{"component": "db", "field": field, "value": mark.Value, "id": mark.Id}).Info("Delta after watermark")
+
+	for ctx.Err() == nil {
+		var (
+			condition = `u.id > ` + strconv.FormatUint(mark.Id, 10)
+			args      []interface{}
+		)
+
+		if mark.Value != "" {
+			condition = `(u.` + field + ` > ? OR (u.` + field + ` = ? AND u.id > ?))`
+			args = []interface{}{mark.Value, mark.Value, mark.Id}
+		}
+
+		users, err := queryUsers(ctx, db, configuration, createSelectUsersQuery(newSqlDialect(configuration), order, limit, condition), args...)
+		if err != nil {
+			return err
+		}
+
+		if len(users) == 0 {
+			// Nothing to fetch
+			break
+		}
+
+		// Users who were deactivated or hid the profile are fetched too
+		page := make([]esreindexer.FetchedRecord, len(users))
+		for i, user := range users {
+			page[i] = userRecord(user)
+		}
+
+		last := users[len(users)-1]
+		mark = &watermark{
+			Value: userFieldValue(last, field),
+			Id:    last.GetId(),
+		}
+
+		checkpoints.TrackWatermark(*mark, page)
+
+		for _, record := range page {
+			if !sendRecord(ctx, channel, record) {
+				return nil
+			}
+		}
+
+		countFetched(ctx, uint64(len(users)))
+		observeFetch(ctx, watermarkPartition, len(users))
+
+		totalCount += uint64(len(users))
+		if totalCount >= maxTotalFetch {
+			// maxTotalFetch reached, the rest is fetched by the next run
+			break
+		}
+	}
+
+	return nil
+}
+
+// Searchable users of the partition after lastId, partitions are id % threads
+func usersPartitionCondition(dialect sqlDialect, lastId uint64, threadsCount string, threadId string) string {
+	return `u.id > ` + strconv.FormatUint(lastId, 10) + ` AND u.id % ` + threadsCount + ` = ` + threadId + ` AND ` + searchableUsersCondition(dialect)
+}
+
+func fetchUsers(
+	ctx context.Context,
+	db *gorm.DB,
+	channel chan esreindexer.FetchedRecord,
+	checkpoints *checkpointTracker,
+	numberOfThread uint64,
+	threadNumber uint64,
+	configuration esreindexer.DataBaseConfig) error {
+
+	var (
+		threadsCount = strconv.FormatUint(numberOfThread, 10)
+		threadId     = strconv.FormatUint(threadNumber, 10)
+		limit        = strconv.FormatUint(uint64(configuration.Limit), 10)
+		dialect      = newSqlDialect(configuration)
+
+		partition = partitionKey("", threadNumber)
+		lastId    = checkpoints.LastId(partition)
+	)
+
+	for ctx.Err() == nil {
+		users, err := queryUsers(ctx, db, configuration, createSelectUsersQuery(dialect, "id ASC", limit, usersPartitionCondition(dialect, lastId, threadsCount, threadId)))
+		if err != nil {
+			return err
 		}
 
-		if lastCount == 0 {
+		if len(users) == 0 {
 			// Nothing to fetch
 			break
 		}
 
-		totalFetch.Add(lastCount)
+		page := make([]esreindexer.FetchedRecord, len(users))
+		for i, user := range users {
+			page[i] = user
+		}
+
+		lastId = users[len(users)-1].GetId()
+
+		if !sendPage(ctx, channel, checkpoints, partition, lastId, page) {
+			return nil
+		}
+
+		countFetched(ctx, uint64(len(users)))
+	}
+
+	return nil
+}
+
+// Tables which changes are followed by users-stream, by default all tables of the users query
+var defaultUsersStreamTables = map[string]string{
+	"users":            "id",
+	"profiles_text":    "id",
+	"user_langs":       "user_id",
+	"user_langs_learn": "user_id",
+}
+
+// Fetches users by ids, ids which are not found anymore are deleted from the index
+func fetchUsersByIds(
+	ctx context.Context,
+	db *gorm.DB,
+	configuration esreindexer.DataBaseConfig,
+	ids []uint64) ([]esreindexer.FetchedRecord, error) {
+
+	var page []esreindexer.FetchedRecord
+
+	for len(ids) > 0 {
+		chunk := ids
+		if len(chunk) > int(configuration.Limit) {
+			chunk = chunk[:configuration.Limit]
+		}
+
+		ids = ids[len(chunk):]
+
+		users, err := queryUsers(
+			ctx,
+			db,
+			configuration,
+			createSelectUsersQuery(newSqlDialect(configuration), "u.id ASC", strconv.Itoa(len(chunk)), `u.id IN (`+formatIds(chunk)+`)`),
+		)
+
+		if err != nil {
+			return nil, err
+		}
+
+		found := map[uint64]bool{}
+		for _, user := range users {
+			found[user.GetId()] = true
+			page = append(page, userRecord(user))
+		}
+
+		for _, id := range chunk {
+			if !found[id] {
+				page = append(page, esreindexer.NewDeletedRecord(esreindexer.User{}.GetIndex(), esreindexer.User{}.GetType(), id))
+			}
+		}
+	}
+
+	return page, nil
+}
+
+// Follows binlog and reindexes users changed in the users tables by micro-batches.
+// Binlog position is the watermark of checkpoints: file name is its value and position is its id.
+func streamUsers(
+	ctx context.Context,
+	db *gorm.DB,
+	channel chan esreindexer.FetchedRecord,
+	checkpoints *checkpointTracker,
+	configuration esreindexer.DataBaseConfig) error {
+
+	if _, ok := newSqlDialect(configuration).(mysqlDialect); !ok {
+		return errors.New("users-stream follows MySQL binlog, it isn't supported by " + configuration.Dialect)
+	}
+
+	syncer, schema, err := newBinlogSyncer(configuration.Binlog, configuration.GetUri(usersSource{}.DataBaseUriKey()))
+	if err != nil {
+		return err
+	}
+
+	defer syncer.Close()
+
+	tables := configuration.Binlog.Tables
+	if len(tables) == 0 {
+		tables = defaultUsersStreamTables
+	}
 
-		rows.Close()
+	columns, err := binlogColumns(ctx, db, configuration, schema, tables)
+	if err != nil {
+		return err
 	}
 
-	wg.Done()
-	log.Print("Finished fetch goroutine ", threadNumber)
+	var position mysql.Position
+
+	if mark := checkpoints.Watermark(); mark != nil {
+		position = mysql.Position{Name: mark.Value, Pos: uint32(mark.Id)}
+	} else {
+		position, err = masterPosition(ctx, db, configuration)
+		if err != nil {
+			return err
+		}
+
+		loggerFromContext(ctx).WithField("component", "db").Warn("There is no saved binlog position, stream starts from the current one, earlier changes need full reindex")
+	}
+
+	loggerFromContext(ctx).WithFields(logrus.Fields{"component": "db", "file": position.Name, "position": position.Pos}).Info("Follow binlog")
+
+	batchSize := defaultBinlogBatchSize
+	if configuration.Binlog.BatchSize > 0 {
+		batchSize = int(configuration.Binlog.BatchSize)
+	}
+
+	batchInterval := defaultBinlogBatchInterval
+	if configuration.Binlog.BatchInterval > 0 {
+		batchInterval = time.Duration(configuration.Binlog.BatchInterval) * time.Millisecond
+	}
+
+	return followBinlog(ctx, syncer, position, schema, columns, batchSize, batchInterval, func(ids []uint64, position mysql.Position) error {
+		page, err := fetchUsersByIds(ctx, db, configuration, ids)
+		if err != nil {
+			return err
+		}
+
+		checkpoints.TrackWatermark(watermark{Value: position.Name, Id: uint64(position.Pos)}, page)
+
+		// Nothing to acknowledge, position of events on other tables is saved right away
+		if len(page) == 0 {
+			return checkpoints.Save()
+		}
+
+		for _, record := range page {
+			if !sendRecord(ctx, channel, record) {
+				return nil
+			}
+		}
+
+		countFetched(ctx, uint64(len(page)))
+		observeFetch(ctx, "stream", len(page))
+
+		return nil
+	})
 }
@@ -0,0 +1,164 @@
+// Copyright 2016-present InterPals. All Rights Reserved.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	esreindexer "github.com/interpals/es-reindexer"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultDryRunDir       = "dry-run"
+	defaultDryRunFileBytes = 100 * 1024 * 1024
+)
+
+func dryRunDir(configuration esreindexer.DryRunConfig) string {
+	if configuration.Dir == "" {
+		return defaultDryRunDir
+	}
+
+	return configuration.Dir
+}
+
+// Sink of -dry-run, it writes action and source lines which would be sent to /_bulk into rotating NDJSON files.
+// Records of a run are written into "bulk-<timestamp>-<number>.ndjson" files of the directory.
+type fileSink struct {
+	mutex sync.Mutex
+
+	// Builds bulk requests only, it isn't connected to Elasticsearch
+	requests *elasticSink
+
+	dir      string
+	prefix   string
+	maxBytes int
+
+	file    *os.File
+	writer  *bufio.Writer
+	number  int
+	written int
+}
+
+func newFileSink(configuration esreindexer.DryRunConfig, indices map[string]string, format documentFormat) (*fileSink, error) {
+	sink := &fileSink{
+		requests: newElasticSink(nil, indices, format),
+		dir:      dryRunDir(configuration),
+		prefix:   "bulk-" + time.Now().Format(indexGenerationLayout),
+		maxBytes: defaultDryRunFileBytes,
+	}
+
+	if configuration.MaxFileBytes > 0 {
+		sink.maxBytes = int(configuration.MaxFileBytes)
+	}
+
+	err := os.MkdirAll(sink.dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return sink, nil
+}
+
+func (this *fileSink) closeFile() error {
+	if this.file == nil {
+		return nil
+	}
+
+	err := this.writer.Flush()
+	if err != nil {
+		return err
+	}
+
+	err = this.file.Close()
+	this.file = nil
+
+	return err
+}
+
+func (this *fileSink) rotate() error {
+	err := this.closeFile()
+	if err != nil {
+		return err
+	}
+
+	this.number++
+
+	path := filepath.Join(this.dir, fmt.Sprintf("%s-%06d.ndjson", this.prefix, this.number))
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	logger.WithFields(logrus.Fields{"component": "dry-run", "path": path}).Info("Write bulk bodies into file")
+
+	this.file = file
+	this.writer = bufio.NewWriter(file)
+	this.written = 0
+
+	return nil
+}
+
+func (this *fileSink) Write(ctx context.Context, records []esreindexer.FetchedRecord) ([]SinkItemResult, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	results := make([]SinkItemResult, len(records))
+
+	for i, record := range records {
+		results[i].Record = record
+
+		lines, err := this.requests.newBulkRequest(record).Source()
+		if err != nil {
+			results[i].ErrorType = "serialization_error"
+			results[i].Error = err.Error()
+			continue
+		}
+
+		body := strings.Join(lines, "\n") + "\n"
+
+		if this.file == nil || (this.written > 0 && this.written+len(body) > this.maxBytes) {
+			err = this.rotate()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		_, err = this.writer.WriteString(body)
+		if err != nil {
+			return nil, err
+		}
+
+		this.written += len(body)
+		results[i].Status = http.StatusOK
+	}
+
+	return results, nil
+}
+
+func (this *fileSink) Flush() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.file == nil {
+		return nil
+	}
+
+	return this.writer.Flush()
+}
+
+func (this *fileSink) Close() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	return this.closeFile()
+}
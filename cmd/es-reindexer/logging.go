@@ -0,0 +1,92 @@
+// Copyright 2016-present InterPals. All Rights Reserved.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+
+	esreindexer "github.com/interpals/es-reindexer"
+	"github.com/sirupsen/logrus"
+)
+
+// Logger of the process, runs and fetch goroutines add their fields through context
+var logger = logrus.New()
+
+func setupLogging(configuration esreindexer.LogConfig) error {
+	logger.SetOutput(os.Stderr)
+
+	if configuration.Level != "" {
+		level, err := logrus.ParseLevel(configuration.Level)
+		if err != nil {
+			return fmt.Errorf("log.level: %s", err)
+		}
+
+		logger.SetLevel(level)
+	}
+
+	switch configuration.Format {
+	case "", "text":
+		logger.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	case "json":
+		logger.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return fmt.Errorf("log.format must be text or json, got %q", configuration.Format)
+	}
+
+	return nil
+}
+
+type loggerKey struct{}
+
+func withLogger(ctx context.Context, entry *logrus.Entry) context.Context {
+	return context.WithValue(ctx, loggerKey{}, entry)
+}
+
+// Logger with fields of the run, partition and so on, the process logger if there are no fields
+func loggerFromContext(ctx context.Context) *logrus.Entry {
+	if entry, ok := ctx.Value(loggerKey{}).(*logrus.Entry); ok {
+		return entry
+	}
+
+	return logrus.NewEntry(logger)
+}
+
+// Short unique id, so log lines of concurrent runs of daemon can be told apart
+func newRunId() string {
+	return strconv.FormatInt(time.Now().Unix(), 36) + "-" + strconv.FormatInt(rand.Int63n(1<<30), 36)
+}
+
+// Routes SQL log of gorm (db.show-log) into the logger at debug level
+type gormLogger struct {
+	entry *logrus.Entry
+}
+
+func (this gormLogger) Print(values ...interface{}) {
+	if len(values) >= 6 && values[0] == "sql" {
+		this.entry.WithFields(logrus.Fields{
+			"component": "db",
+			"source":    values[1],
+			"duration":  values[2],
+			"vars":      values[4],
+			"rows":      values[5],
+		}).Debug(values[3])
+
+		return
+	}
+
+	if len(values) >= 2 {
+		this.entry.WithFields(logrus.Fields{
+			"component": "db",
+			"source":    values[1],
+		}).Debug(values[2:]...)
+
+		return
+	}
+
+	this.entry.WithField("component", "db").Debug(values...)
+}
@@ -5,182 +5,159 @@ package main
 import (
 	esreindexer "github.com/interpals/es-reindexer"
 	"flag"
+	"fmt"
 	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
 	"github.com/jinzhu/gorm"
 	"github.com/olivere/elastic"
-	"log"
+	"github.com/sirupsen/logrus"
 	"os"
-	"runtime"
-	"strconv"
+	"os/signal"
 	"sync"
+	"syscall"
 	"context"
-	"time"
 )
 
-func startFetch(db *gorm.DB, eschan chan esreindexer.FetchedRecord, configuration esreindexer.DataBaseConfig, command string) {
+// Holds the first fatal error of the run, reporting an error stops fetching
+type fatalError struct {
+	mutex  sync.Mutex
+	err    error
+	cancel context.CancelFunc
+}
+
+func newFatalError(cancel context.CancelFunc) *fatalError {
+	return &fatalError{
+		cancel: cancel,
+	}
+}
+
+func (this *fatalError) Report(err error) {
+	this.mutex.Lock()
+	if this.err == nil {
+		this.err = err
+	}
+	this.mutex.Unlock()
+
+	this.cancel()
+}
+
+func (this *fatalError) Err() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	return this.err
+}
+
+func startFetch(
+	ctx context.Context,
+	fatal *fatalError,
+	db *gorm.DB,
+	eschan chan esreindexer.FetchedRecord,
+	checkpoints *checkpointTracker,
+	configuration esreindexer.DataBaseConfig,
+	source Source) {
+
 	var wg *sync.WaitGroup = new(sync.WaitGroup)
 	threadsNumbers := uint64(configuration.Threads)
 
 	for i := uint64(0); i < threadsNumbers; i++ {
 		wg.Add(1)
 
-		switch command {
-		case "users":
-			go fetchUsers(db.New(), eschan, wg, threadsNumbers, i, configuration)
-			break
-		case "geo":
-			go fetchGeo(db.New(), eschan, wg, threadsNumbers, i, configuration)
-			break
-		default:
-			panic("Unknown command to process")
-		}
+		go func(threadNumber uint64) {
+			partitionLog := loggerFromContext(ctx).WithField("partition", threadNumber)
 
+			err := source.Fetch(withLogger(ctx, partitionLog), db.New(), eschan, checkpoints, threadsNumbers, threadNumber, configuration)
+			if err != nil {
+				partitionLog.WithError(err).Error("Fetch goroutine failed")
+				fatal.Report(err)
+			}
+
+			wg.Done()
+			partitionLog.Info("Finished fetch goroutine")
+		}(i)
 	}
 
 	// Don't close users channel before all fetch goroutines will finish
 	wg.Wait()
 
-	log.Print("Wait group for fetch finished")
-	log.Print("Total Fetched ", totalFetch.Value())
-
-	// No users, lets close channel to stop range query and send latest bulk request
-	close(eschan)
+	loggerFromContext(ctx).WithField("fetched", runCountersFromContext(ctx).Fetched()).Info("Fetch finished")
 }
 
 func startFetchDelta(
+	ctx context.Context,
+	fatal *fatalError,
 	db *gorm.DB,
-	users chan esreindexer.FetchedRecord,
+	eschan chan esreindexer.FetchedRecord,
+	checkpoints *checkpointTracker,
 	configuration esreindexer.DataBaseConfig,
-	model string,
+	source DeltaSource,
 	field string,
 	maxTotalFetch uint64) {
 
-	if model != "users" {
-		panic("Model is not supported, only user supported now")
+	err := source.FetchDelta(ctx, db, eschan, checkpoints, configuration, field, maxTotalFetch)
+	if err != nil {
+		loggerFromContext(ctx).WithError(err).Error("Delta fetch failed")
+		fatal.Report(err)
 	}
 
-	var (
-		limit = strconv.FormatUint(uint64(configuration.Limit), 10)
-
-		lastCount  uint64
-		totalCount uint64 = 0
-	)
-
-	for {
-		lastCount = 0
-
-		rows, err := db.Raw(createSelectUsersQuery(field+" DESC", limit, "")).Rows()
-		if err != nil {
-			panic(err)
-		}
-
-		for rows.Next() {
-			lastCount++
-
-			var user esreindexer.User
-
-			err := db.ScanRows(rows, &user)
-			if err != nil {
-				panic(err)
-			}
-
-			user.Prepare()
-			users <- user
-		}
-
-		if lastCount == 0 {
-			// Nothing to fetch
-			break
-		}
+	// No records, lets close channel to stop range query and send latest bulk request
+	close(eschan)
+}
 
-		totalFetch.Add(lastCount)
-		rows.Close()
+func startStream(
+	ctx context.Context,
+	fatal *fatalError,
+	db *gorm.DB,
+	eschan chan esreindexer.FetchedRecord,
+	checkpoints *checkpointTracker,
+	configuration esreindexer.DataBaseConfig,
+	source StreamSource) {
 
-		totalCount += lastCount
-		if totalCount >= maxTotalFetch {
-			// maxTotalFetch reached, lets exit from fetch
-			break
-		}
+	err := source.Stream(ctx, db, eschan, checkpoints, configuration)
+	if err != nil {
+		loggerFromContext(ctx).WithError(err).Error("Stream failed")
+		fatal.Report(err)
 	}
 
-	// No users, lets close channel to stop range query and send latest bulk request
-	close(users)
+	close(eschan)
 }
 
-func processFetchedRecords(
+// Moves alias to the rebuilt index
+func finishRebuild(
+	ctx context.Context,
 	client *elastic.Client,
-	fetchedRecords chan esreindexer.FetchedRecord,
-	wg *sync.WaitGroup,
-	configuration esreindexer.ElasticSearchConfig) {
-
-	var memStats runtime.MemStats
-	bulkRequest := client.Bulk()
-
-	for record := range fetchedRecords {
-		request := elastic.NewBulkIndexRequest().
-			Index(record.GetIndex()).
-			Type(record.GetType()).
-			Id(strconv.FormatUint(record.GetId(), 10)).
-			Doc(record.GetSearchData())
-
-		parent := record.GetParent()
-		if parent != nil {
-			request.Parent(strconv.FormatUint(*parent, 10))
-		}
-
-		bulkRequest.Add(request)
-
-		if bulkRequest.NumberOfActions() >= int(configuration.Limit) {
-			totalSend.Add(uint64(bulkRequest.NumberOfActions()))
+	alias string,
+	index string,
+	configuration esreindexer.ElasticSearchConfig) error {
 
-			runtime.ReadMemStats(&memStats)
-			log.Print(
-				"[ES] Bulk insert ", bulkRequest.NumberOfActions(),
-				" buffer ", len(fetchedRecords),
-				" fetch ", totalFetch.Value(),
-				" send ", totalSend.Value(),
-				" alloc ", memStats.Alloc/1024/1024, "mb",
-				" HeapObjects ", memStats.HeapObjects)
-
-			ctx := context.Background()
-			_, err := bulkRequest.Do(ctx)
-			if err != nil {
-				panic(err)
-			}
-
-			bulkRequest = client.Bulk()
-		}
+	err := swapAlias(ctx, client, alias, index)
+	if err != nil {
+		return fmt.Errorf("cannot move alias %s to %s: %s", alias, index, err)
 	}
 
-	log.Print("Closed channel")
-
-	if bulkRequest.NumberOfActions() > 0 {
-		log.Print("Latest Bulk insert go ", bulkRequest.NumberOfActions())
-
-		ctx := context.Background()
-		_, err := bulkRequest.Do(ctx)
-		if err != nil {
-			panic(err)
-		}
+	err = removeOldIndexGenerations(ctx, client, alias, index, int(configuration.IndexRetention))
+	if err != nil {
+		// Alias is already moved, so the rebuild is done anyway
+		loggerFromContext(ctx).WithField("alias", alias).WithError(err).Warn("Cannot remove old generations")
 	}
 
-	wg.Done()
+	return nil
 }
 
-func startProcessing(
-	client *elastic.Client,
-	fetchedRecords chan esreindexer.FetchedRecord,
-	configuration esreindexer.ElasticSearchConfig) {
-
-	var wg *sync.WaitGroup = new(sync.WaitGroup)
+// Cancels context on SIGINT/SIGTERM, the second signal terminates process immediately
+func handleSignals(cancel context.CancelFunc) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 
-	for i := uint8(0); i < configuration.Threads; i++ {
-		wg.Add(1)
-		go processFetchedRecords(client, fetchedRecords, wg, configuration)
-	}
+	go func() {
+		sig := <-signals
+		logger.WithField("signal", sig.String()).Warn("Stop fetching and flush buffered records")
+		cancel()
 
-	// Don't close fetchedRecords channel before all fetch goroutines will finish
-	wg.Wait()
+		sig = <-signals
+		logger.WithField("signal", sig.String()).Warn("Received signal again, exit without flush")
+		os.Exit(1)
+	}()
 }
 
 var (
@@ -193,6 +170,11 @@ func main() {
 		configFile    string
 		field         string
 		maxTotalFetch uint64
+		resume        bool
+		rebuild       bool
+		repair        bool
+		dryRun        bool
+		cluster       string
 	)
 
 	// I cannot define flags parsing inside command with standart library, this will cause a problem
@@ -201,6 +183,13 @@ func main() {
 	flag.StringVar(&configFile, "config", "", "Config filepath")
 	flag.StringVar(&field, "field", "signup", "What field will be used on delta sort")
 	flag.Uint64Var(&maxTotalFetch, "total", 1000, "How many records we will fetch before exit")
+	flag.BoolVar(&resume, "resume", false, "Continue full reindex from the checkpoint of interrupted run")
+	flag.BoolVar(&rebuild, "rebuild", false, "Full reindex into a new index generation and move alias to it")
+
+	flag.BoolVar(&repair, "repair", false, "With verify, index missing records and delete extra ones")
+
+	flag.BoolVar(&dryRun, "dry-run", false, "Write bulk bodies into files of dry-run.dir instead of Elasticsearch")
+	flag.StringVar(&cluster, "cluster", "", "Name of elasticsearch.clusters to use instead of the default connection")
 
 	flag.Parse()
 
@@ -209,73 +198,110 @@ func main() {
 	}
 
 	var config esreindexer.Configuration
-	config.Init(configFile)
 
+	err := config.Init(configFile)
+	if err != nil {
+		logger.WithField("path", configFile).Error(err)
+		os.Exit(1)
+	}
 
-	var dbUri string
-	var model string
-	command := flag.Arg(0)
+	err = setupLogging(config.Log)
+	if err != nil {
+		panic(err)
+	}
 
-	switch command {
-		case "users-delta":
-			fallthrough
-		case "users":
-			dbUri = config.DataBase.Uri
-			model = "users"
-			break;
-		case "geo":
-			dbUri = config.DataBase.UriGeo
-			model = "geo"
-			break;
-		default:
-			log.Print("Usage: es-reindexer [users|geo|users-delta]")
-			os.Exit(1)
-			break
+	for _, warning := range config.Warnings {
+		logger.WithField("path", configFile).Warn(warning)
 	}
 
-	db, err := gorm.Open(config.DataBase.Dialect, dbUri)
 
-	if err != nil {
-		panic(err)
+	command := flag.Arg(0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	handleSignals(cancel)
+
+	if dryRun && (command == "create-index" || command == "daemon") {
+		panic("-dry-run is supported only by reindex commands")
 	}
-	defer db.Close()
 
-	client, err := elastic.NewClient(elastic.SetURL(config.ElasticSearch.Uri))
-	if err != nil {
-		panic(err)
+	// Dry run doesn't need Elasticsearch
+	var client *elastic.Client
+
+	if !dryRun {
+		connection, err := selectCluster(config.ElasticSearch, cluster)
+		if err != nil {
+			logger.Error(err)
+			os.Exit(1)
+		}
+
+		client, err = newElasticClient(connection)
+		if err != nil {
+			panic(err)
+		}
 	}
 
-	db.LogMode(config.DataBase.ShowLog)
-	db.DB().SetMaxIdleConns(config.DataBase.MaxIdleConnections)
-	db.DB().SetMaxOpenConns(config.DataBase.MaxOpenConnections)
+	if command == "create-index" {
+		name := flag.Arg(1)
+		if name == "" {
+			logger.Error("Usage: es-reindexer create-index <index>")
+			os.Exit(1)
+		}
 
-	fetchedRecords := make(chan esreindexer.FetchedRecord, config.ChannelBufferSize) // async channel
+		// Model name is accepted too
+		if source, ok := lookupSource(name); ok {
+			name = source.Index()
+		}
 
-	switch command {
-	case "users-delta":
-		if field != "signup" && field != "last_login" && field != "modified" {
-			panic("Sort field must be [signup, last_login, modified]")
+		format, err := newDocumentFormat(ctx, client, config.ElasticSearch)
+		if err != nil {
+			panic(err)
 		}
 
-		if maxTotalFetch < 100 || maxTotalFetch > 100000 {
-			panic("Total must be 100 < x < 100k")
+		err = createIndex(ctx, client, name, name, config.ElasticSearch, format)
+		if err != nil {
+			panic(err)
 		}
 
-		log.Print("Sort field ", field)
-		log.Print("Max total fetch ", maxTotalFetch)
-
-		go startFetchDelta(db, fetchedRecords, config.DataBase, model, field, maxTotalFetch)
-		break
-	case "users":
-		go startFetch(db, fetchedRecords, config.DataBase, command)
-		break
-	case "geo":
-		go startFetch(db, fetchedRecords, config.DataBase, command)
-		break
+		logger.WithFields(logrus.Fields{"component": "es", "index": name}).Info("Created index")
+		return
 	}
 
-	time.Sleep(time.Millisecond * 5000)
-	startProcessing(client, fetchedRecords, config.ElasticSearch)
+	dbs := newDatabases(config.DataBase)
+
+	var d *daemon
+	if command == "daemon" {
+		d = newDaemon(client, dbs, config)
+	}
+
+	if config.HttpListen != "" {
+		err = startHttpServer(config.HttpListen, &adminApi{ctx: ctx, client: client, dbs: dbs, daemon: d})
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if d != nil {
+		err = d.Run(ctx)
+	} else {
+		err = run(ctx, client, dbs, config, runOptions{
+			command:       command,
+			argument:      flag.Arg(1),
+			dir:           flag.Arg(2),
+			field:         field,
+			maxTotalFetch: maxTotalFetch,
+			resume:        resume,
+			rebuild:       rebuild,
+			repair:        repair,
+			dryRun:        dryRun,
+		})
+	}
+
+	dbs.Close()
+
+	if err != nil {
+		logger.WithError(err).Error("Finished with error")
+		os.Exit(1)
+	}
 
-	log.Print("Finished ")
+	logger.Info("Finished")
 }
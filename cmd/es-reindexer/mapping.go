@@ -0,0 +1,206 @@
+// Copyright 2016-present InterPals. All Rights Reserved.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	esreindexer "github.com/interpals/es-reindexer"
+	"github.com/olivere/elastic"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	mappingCheckWarn  = "warn"
+	mappingCheckAbort = "abort"
+	mappingCheckOff   = "off"
+)
+
+func readJSONFile(path string) (map[string]interface{}, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var result map[string]interface{}
+
+	err = json.Unmarshal(content, &result)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %s", path, err)
+	}
+
+	return result, nil
+}
+
+// Body of create index request built from mapping and settings files, nil if there are no files
+func indexBody(alias string, configuration esreindexer.IndexConfig, format documentFormat) (map[string]interface{}, error) {
+	body := map[string]interface{}{}
+
+	if configuration.Settings != "" {
+		settings, err := readJSONFile(configuration.Settings)
+		if err != nil {
+			return nil, err
+		}
+
+		body["settings"] = settings
+	}
+
+	if configuration.Mapping != "" {
+		mapping, err := readJSONFile(configuration.Mapping)
+		if err != nil {
+			return nil, err
+		}
+
+		body["mappings"] = format.mapping(alias, mapping)
+	}
+
+	if len(body) == 0 {
+		return nil, nil
+	}
+
+	return body, nil
+}
+
+// Creates index with mapping and settings configured for alias (or index itself)
+func createIndex(
+	ctx context.Context,
+	client *elastic.Client,
+	alias string,
+	index string,
+	configuration esreindexer.ElasticSearchConfig,
+	format documentFormat) error {
+
+	body, err := indexBody(alias, configuration.Indices[alias], format)
+	if err != nil {
+		return err
+	}
+
+	service := client.CreateIndex(index)
+	if body != nil {
+		service.BodyJson(body)
+	} else {
+		loggerFromContext(ctx).WithFields(logrus.Fields{"component": "es", "alias": alias, "index": index}).Warn("There is no mapping, index will use dynamic mapping")
+	}
+
+	_, err = service.Do(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot create index %s: %s", index, err)
+	}
+
+	return nil
+}
+
+// Compares expected mapping from the file with the live one, returns human readable differences.
+// Parameters which exist only in the live mapping are defaults filled in by Elasticsearch, they are ignored.
+// Fields which exist only in the live mapping are reported, they are usually added by dynamic mapping.
+func diffMapping(path string, expected interface{}, actual interface{}) []string {
+	expectedMap, expectedIsMap := expected.(map[string]interface{})
+	actualMap, actualIsMap := actual.(map[string]interface{})
+
+	// Elasticsearch returns some values as strings, for example "dynamic": "false"
+	if !expectedIsMap || !actualIsMap {
+		if fmt.Sprint(expected) != fmt.Sprint(actual) {
+			return []string{fmt.Sprintf("%s: %v in file, %v in index", path, expected, actual)}
+		}
+
+		return nil
+	}
+
+	var differences []string
+
+	for key, value := range expectedMap {
+		actualValue, ok := actualMap[key]
+		if !ok {
+			differences = append(differences, path+"."+key+": missing in index")
+			continue
+		}
+
+		differences = append(differences, diffMapping(path+"."+key, value, actualValue)...)
+	}
+
+	if strings.HasSuffix(path, ".properties") {
+		for key := range actualMap {
+			if _, ok := expectedMap[key]; !ok {
+				differences = append(differences, path+"."+key+": missing in file")
+			}
+		}
+	}
+
+	sort.Strings(differences)
+
+	return differences
+}
+
+// Checks that mapping of the live index (or indices behind alias) matches the mapping file
+func checkMapping(
+	ctx context.Context,
+	client *elastic.Client,
+	alias string,
+	configuration esreindexer.ElasticSearchConfig,
+	format documentFormat) error {
+
+	mode := configuration.MappingCheck
+	if mode == "" {
+		mode = mappingCheckWarn
+	}
+
+	path := configuration.Indices[alias].Mapping
+	if mode == mappingCheckOff || path == "" {
+		return nil
+	}
+
+	file, err := readJSONFile(path)
+	if err != nil {
+		return err
+	}
+
+	expected := format.mapping(alias, file)
+
+	live, err := client.GetMapping().Index(alias).Do(ctx)
+	if err != nil {
+		return err
+	}
+
+	var differences []string
+
+	for index, value := range live {
+		indexMapping, _ := value.(map[string]interface{})
+		mappings, _ := indexMapping["mappings"].(map[string]interface{})
+
+		if format.typeless {
+			differences = append(differences, diffMapping(index, expected, mappings)...)
+			continue
+		}
+
+		// Only types described in the file are compared, so _default_ and similar aren't reported
+		actual := map[string]interface{}{}
+		if mappings != nil {
+			for typ := range expected {
+				if typeMapping, ok := mappings[typ]; ok {
+					actual[typ] = typeMapping
+				}
+			}
+		}
+
+		differences = append(differences, diffMapping(index, expected, actual)...)
+	}
+
+	if len(differences) == 0 {
+		return nil
+	}
+
+	for _, difference := range differences {
+		loggerFromContext(ctx).WithFields(logrus.Fields{"component": "es", "path": path}).Warn("Mapping differs: ", difference)
+	}
+
+	if mode == mappingCheckAbort {
+		return fmt.Errorf("mapping of %s differs from %s in %d places", alias, path, len(differences))
+	}
+
+	return nil
+}
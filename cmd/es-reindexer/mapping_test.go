@@ -0,0 +1,96 @@
+// Copyright 2016-present InterPals. All Rights Reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func decodeMapping(t *testing.T, content string) interface{} {
+	var mapping interface{}
+
+	err := json.Unmarshal([]byte(content), &mapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return mapping
+}
+
+func TestDiffMapping(t *testing.T) {
+	expected := decodeMapping(t, `{
+		"city": {
+			"properties": {
+				"suggest": {"type": "completion", "analyzer": "simple"},
+				"population": {"type": "integer"},
+				"timezone": {"type": "keyword"}
+			}
+		}
+	}`)
+
+	tests := []struct {
+		name        string
+		actual      string
+		differences []string
+	}{
+		{
+			"defaults of index created from the file",
+			`{
+				"city": {
+					"properties": {
+						"suggest": {
+							"type": "completion",
+							"analyzer": "simple",
+							"search_analyzer": "simple",
+							"preserve_separators": true,
+							"preserve_position_increments": true,
+							"max_input_length": 50
+						},
+						"population": {"type": "integer"},
+						"timezone": {"type": "keyword"}
+					}
+				}
+			}`,
+			nil,
+		},
+		{
+			"changed and dynamic fields",
+			`{
+				"city": {
+					"properties": {
+						"suggest": {"type": "completion", "analyzer": "standard"},
+						"population": {"type": "long"},
+						"timezone": {"type": "keyword"},
+						"name": {"type": "text"}
+					}
+				}
+			}`,
+			[]string{
+				"geo.city.properties.name: missing in file",
+				"geo.city.properties.population.type: integer in file, long in index",
+				"geo.city.properties.suggest.analyzer: simple in file, standard in index",
+			},
+		},
+		{
+			"missing field",
+			`{
+				"city": {
+					"properties": {
+						"suggest": {"type": "completion", "analyzer": "simple"},
+						"population": {"type": "integer"}
+					}
+				}
+			}`,
+			[]string{"geo.city.properties.timezone: missing in index"},
+		},
+	}
+
+	for _, test := range tests {
+		differences := diffMapping("geo", expected, decodeMapping(t, test.actual))
+		if !reflect.DeepEqual(differences, test.differences) {
+			t.Errorf("%s: expected %q, got %q", test.name, test.differences, differences)
+		}
+	}
+}
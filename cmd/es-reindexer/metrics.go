@@ -0,0 +1,137 @@
+// Copyright 2016-present InterPals. All Rights Reserved.
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	esreindexer "github.com/interpals/es-reindexer"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+// How often occupancy of the records channel is sampled
+const channelSampleInterval = time.Second
+
+// Metrics are registered in the default registry, it exposes Go runtime and process stats too
+var (
+	fetchedRows = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "esreindexer",
+		Name:      "fetched_rows_total",
+		Help:      "Records fetched from the database by model and partition.",
+	}, []string{"model", "partition"})
+
+	sentDocuments = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "esreindexer",
+		Name:      "sent_documents_total",
+		Help:      "Documents sent in bulk requests by index.",
+	}, []string{"index"})
+
+	bulkDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "esreindexer",
+		Name:      "bulk_duration_seconds",
+		Help:      "Latency of bulk requests.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+	})
+
+	bulkFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "esreindexer",
+		Name:      "bulk_failures_total",
+		Help:      "Failed bulk requests and items by reason, retried ones are counted on every attempt.",
+	}, []string{"reason"})
+
+	channelRecords = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "esreindexer",
+		Name:      "channel_buffer_records",
+		Help:      "Fetched records waiting in the channel for processing by command.",
+	}, []string{"command"})
+
+	dbQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "esreindexer",
+		Name:      "db_query_duration_seconds",
+		Help:      "Latency of database queries including reading of rows by model.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"model"})
+)
+
+func init() {
+	prometheus.MustRegister(fetchedRows, sentDocuments, bulkDuration, bulkFailures, channelRecords, dbQueryDuration)
+}
+
+type fetchModelKey struct{}
+
+func withFetchModel(ctx context.Context, model string) context.Context {
+	return context.WithValue(ctx, fetchModelKey{}, model)
+}
+
+// Model which is fetched, it's used as label of metrics
+func fetchModelFromContext(ctx context.Context) string {
+	model, _ := ctx.Value(fetchModelKey{}).(string)
+	return model
+}
+
+func observeFetch(ctx context.Context, partition string, count int) {
+	fetchedRows.WithLabelValues(fetchModelFromContext(ctx), partition).Add(float64(count))
+}
+
+func observeSend(batch []esreindexer.FetchedRecord) {
+	counts := map[string]int{}
+	for _, record := range batch {
+		counts[record.GetIndex()]++
+	}
+
+	for index, count := range counts {
+		sentDocuments.WithLabelValues(index).Add(float64(count))
+	}
+}
+
+// Samples number of buffered records until the returned function is called
+func watchChannel(command string, channel chan esreindexer.FetchedRecord) func() {
+	gauge := channelRecords.WithLabelValues(command)
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(channelSampleInterval)
+		defer ticker.Stop()
+
+		for {
+			gauge.Set(float64(len(channel)))
+
+			select {
+			case <-ticker.C:
+			case <-done:
+				gauge.Set(0)
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
+
+// Serves /metrics and admin API on the address, address which cannot be listened fails right away
+func startHttpServer(address string, api *adminApi) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	api.Register(mux)
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	logger.WithFields(logrus.Fields{"component": "http", "address": listener.Addr().String()}).Info("Listen")
+
+	go func() {
+		err := http.Serve(listener, mux)
+		logger.WithField("component", "http").WithError(err).Error("Server stopped")
+	}()
+
+	return nil
+}
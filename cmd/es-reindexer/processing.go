@@ -0,0 +1,316 @@
+// Copyright 2016-present InterPals. All Rights Reserved.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	esreindexer "github.com/interpals/es-reindexer"
+	"github.com/sirupsen/logrus"
+)
+
+// Bulk which isn't full is sent after this interval
+const defaultFlushInterval = time.Second
+
+// Writes fetched records into Sink, shared between processing goroutines
+type processor struct {
+	sink          Sink
+	deadLetters   *deadLetterWriter
+	checkpoints   *checkpointTracker
+	bulkSize      *bulkSizeController
+	fatal         *fatalError
+	flushInterval time.Duration
+	configuration esreindexer.ElasticSearchConfig
+}
+
+func newProcessor(
+	sink Sink,
+	deadLetters *deadLetterWriter,
+	checkpoints *checkpointTracker,
+	fatal *fatalError,
+	configuration esreindexer.ElasticSearchConfig) *processor {
+
+	processor := &processor{
+		sink:          sink,
+		deadLetters:   deadLetters,
+		checkpoints:   checkpoints,
+		bulkSize:      newBulkSizeController(configuration),
+		fatal:         fatal,
+		flushInterval: defaultFlushInterval,
+		configuration: configuration,
+	}
+
+	if configuration.FlushInterval > 0 {
+		processor.flushInterval = time.Duration(configuration.FlushInterval) * time.Millisecond
+	}
+
+	return processor
+}
+
+func (this *processor) sendBulk(ctx context.Context, batch []esreindexer.FetchedRecord, bytes int, buffer int) error {
+	var memStats runtime.MemStats
+
+	countSent(ctx, uint64(len(batch)))
+	observeSend(batch)
+
+	runtime.ReadMemStats(&memStats)
+	loggerFromContext(ctx).WithFields(logrus.Fields{
+		"component":    "es",
+		"batch":        len(batch),
+		"bytes":        bytes,
+		"buffer":       buffer,
+		"fetched":      runCountersFromContext(ctx).Fetched(),
+		"sent":         runCountersFromContext(ctx).Sent(),
+		"alloc-mb":     memStats.Alloc / 1024 / 1024,
+		"heap-objects": memStats.HeapObjects,
+	}).Info("Bulk insert")
+
+	return this.writeBatch(ctx, batch)
+}
+
+// Writes records until the channel is closed, so buffered records are flushed on shutdown too.
+// Bulk which isn't full is sent by flush interval, records of streams come slowly.
+func (this *processor) processFetchedRecords(
+	ctx context.Context,
+	fetchedRecords chan esreindexer.FetchedRecord,
+	wg *sync.WaitGroup) {
+
+	var bytes int
+
+	batch := make([]esreindexer.FetchedRecord, 0, this.configuration.Limit)
+
+	send := func() bool {
+		err := this.sendBulk(ctx, batch, bytes, len(fetchedRecords))
+		if err != nil {
+			this.fatal.Report(err)
+			return false
+		}
+
+		batch = make([]esreindexer.FetchedRecord, 0, this.configuration.Limit)
+		bytes = 0
+
+		return true
+	}
+
+	flush := time.NewTicker(this.flushInterval)
+	defer flush.Stop()
+
+loop:
+	for {
+		select {
+		case record, ok := <-fetchedRecords:
+			if !ok {
+				break loop
+			}
+
+			record, size := encodeRecord(record)
+
+			// Record which doesn't fit goes into the next bulk, only a single record can be over the limit
+			if len(batch) > 0 && bytes+size > this.bulkSize.MaxBytes() && !send() {
+				break loop
+			}
+
+			batch = append(batch, record)
+			bytes += size
+
+			if len(batch) < this.bulkSize.Limit() && bytes < this.bulkSize.MaxBytes() {
+				continue
+			}
+		case <-flush.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		if !send() {
+			break
+		}
+	}
+
+	// Dispatcher must not block on the worker which stopped because of fatal error
+	for range fetchedRecords {
+	}
+
+	loggerFromContext(ctx).Debug("Closed channel")
+
+	if len(batch) > 0 && this.fatal.Err() == nil {
+		loggerFromContext(ctx).WithFields(logrus.Fields{"component": "es", "batch": len(batch)}).Info("Latest bulk insert")
+
+		err := this.writeBatch(ctx, batch)
+		if err != nil {
+			this.fatal.Report(err)
+		}
+	}
+
+	wg.Done()
+}
+
+// Some items of the batch are still rejected after all attempts
+type rejectedItemsError struct {
+	count int
+}
+
+func (this rejectedItemsError) Error() string {
+	return fmt.Sprintf("%d items of bulk are rejected", this.count)
+}
+
+// Items rejected because of cluster overload or unavailable shards
+func isRetryableItem(result SinkItemResult) bool {
+	return result.Status == http.StatusTooManyRequests ||
+		result.Status == http.StatusServiceUnavailable ||
+		result.ErrorType == "es_rejected_execution_exception"
+}
+
+// Writes batch retrying it as a whole on errors and only its failed items on retryable item failures.
+// Records which can't be encoded, items which failed permanently or are still failing after the last attempt
+// go to the dead-letter file.
+// The whole batch is acknowledged for checkpoints after that.
+func (this *processor) writeBatch(ctx context.Context, batch []esreindexer.FetchedRecord) error {
+	bulkWorkers.Acquire()
+	defer bulkWorkers.Release()
+
+	var (
+		pending []esreindexer.FetchedRecord
+		failed  []SinkItemResult
+		retried []SinkItemResult
+	)
+
+	for _, record := range batch {
+		if unencodable, ok := record.(unencodableRecord); ok {
+			bulkFailures.WithLabelValues("serialization_error").Inc()
+			failed = append(failed, unencodable.result())
+			continue
+		}
+
+		pending = append(pending, record)
+	}
+
+	err := retry(ctx, this.configuration.Retry, "[ES] Bulk", func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+
+		started := time.Now()
+		results, err := this.sink.Write(ctx, pending)
+		latency := time.Since(started)
+
+		bulkDuration.Observe(latency.Seconds())
+
+		if err != nil {
+			bulkFailures.WithLabelValues("request").Inc()
+			this.bulkSize.Observe(latency, isThrottlingError(err))
+			return err
+		}
+
+		pending = nil
+		retried = nil
+
+		for _, result := range results {
+			if !result.Failed() {
+				continue
+			}
+
+			bulkFailures.WithLabelValues(result.ErrorType).Inc()
+
+			if isRetryableItem(result) {
+				pending = append(pending, result.Record)
+				retried = append(retried, result)
+			} else {
+				failed = append(failed, result)
+			}
+		}
+
+		loggerFromContext(ctx).WithFields(logrus.Fields{
+			"component": "es",
+			"batch":     len(results),
+			"duration":  latency,
+			"rejected":  len(pending),
+			"failed":    len(failed),
+		}).Info("Bulk is written")
+		this.bulkSize.Observe(latency, len(pending) > 0)
+
+		if len(pending) > 0 {
+			return rejectedItemsError{count: len(pending)}
+		}
+
+		return nil
+	})
+
+	if _, ok := err.(rejectedItemsError); err != nil && !ok {
+		return err
+	}
+
+	failed = append(failed, retried...)
+	if len(failed) > 0 {
+		loggerFromContext(ctx).WithFields(logrus.Fields{
+			"component":   "es",
+			"batch":       len(batch),
+			"failed":      len(failed),
+			"error-type":  failed[0].ErrorType,
+			"first-error": failed[0].Error,
+		}).Warn("Bulk items failed")
+
+		err = this.deadLetters.Write(failed)
+		if err != nil {
+			return err
+		}
+	}
+
+	this.checkpoints.Ack(batch)
+
+	return nil
+}
+
+// Records with the same id always go to the same worker, so consecutive changes of a document,
+// for example of users-stream, are written in the order they were fetched
+func dispatchRecords(fetchedRecords chan esreindexer.FetchedRecord, workers []chan esreindexer.FetchedRecord) {
+	for record := range fetchedRecords {
+		workers[record.GetId()%uint64(len(workers))] <- record
+	}
+
+	for _, worker := range workers {
+		close(worker)
+	}
+}
+
+func startProcessing(
+	ctx context.Context,
+	processor *processor,
+	fetchedRecords chan esreindexer.FetchedRecord) {
+
+	var wg *sync.WaitGroup = new(sync.WaitGroup)
+
+	workers := make([]chan esreindexer.FetchedRecord, processor.configuration.Threads)
+
+	for i := range workers {
+		workers[i] = make(chan esreindexer.FetchedRecord, processor.configuration.Limit)
+
+		wg.Add(1)
+		go processor.processFetchedRecords(ctx, workers[i], wg)
+	}
+
+	go dispatchRecords(fetchedRecords, workers)
+
+	// Don't close fetchedRecords channel before all fetch goroutines will finish
+	wg.Wait()
+
+	err := processor.sink.Flush()
+	if err != nil {
+		processor.fatal.Report(err)
+	}
+
+	err = processor.sink.Close()
+	if err != nil {
+		processor.fatal.Report(err)
+	}
+
+	err = processor.deadLetters.Close()
+	if err != nil {
+		processor.fatal.Report(err)
+	}
+}
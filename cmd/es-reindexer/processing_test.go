@@ -0,0 +1,222 @@
+// Copyright 2016-present InterPals. All Rights Reserved.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	esreindexer "github.com/interpals/es-reindexer"
+)
+
+// Sink which keeps written batches
+type recordingSink struct {
+	mutex   sync.Mutex
+	batches [][]esreindexer.FetchedRecord
+}
+
+func (this *recordingSink) Write(ctx context.Context, records []esreindexer.FetchedRecord) ([]SinkItemResult, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.batches = append(this.batches, records)
+
+	results := make([]SinkItemResult, len(records))
+	for i, record := range records {
+		results[i].Record = record
+	}
+
+	return results, nil
+}
+
+func (this *recordingSink) Flush() error {
+	return nil
+}
+
+func (this *recordingSink) Close() error {
+	return nil
+}
+
+func newTestRecord(id uint64, sourceSize int) esreindexer.RawRecord {
+	return esreindexer.RawRecord{
+		Index:  "users",
+		Type:   "users",
+		Id:     id,
+		Source: json.RawMessage(`"` + strings.Repeat("x", sourceSize-2) + `"`),
+	}
+}
+
+func TestProcessFetchedRecordsKeepsBulkBytes(t *testing.T) {
+	const maxBytes = 1000
+
+	sink := &recordingSink{}
+	processor := newProcessor(sink, newDeadLetterWriter(""), nil, newFatalError(func() {}), esreindexer.ElasticSearchConfig{
+		Limit:        100,
+		MaxBulkBytes: maxBytes,
+	})
+
+	records := make(chan esreindexer.FetchedRecord, 20)
+	for i := uint64(1); i <= 20; i++ {
+		records <- newTestRecord(i, 100)
+	}
+
+	close(records)
+
+	var wg *sync.WaitGroup = new(sync.WaitGroup)
+	wg.Add(1)
+	processor.processFetchedRecords(context.Background(), records, wg)
+
+	var next uint64 = 1
+
+	for _, batch := range sink.batches {
+		bytes := 0
+
+		for _, record := range batch {
+			if record.GetId() != next {
+				t.Fatalf("expected record %d, got %d", next, record.GetId())
+			}
+
+			bytes += len(record.(esreindexer.RawRecord).Source) + bulkActionLineOverhead
+			next++
+		}
+
+		if bytes > maxBytes {
+			t.Errorf("bulk of %d records has %d bytes, limit is %d", len(batch), bytes, maxBytes)
+		}
+	}
+
+	if next != 21 {
+		t.Errorf("expected 20 records, got %d", next-1)
+	}
+}
+
+func TestEncodeRecord(t *testing.T) {
+	user := esreindexer.User{Id: 10}
+
+	encoded, size := encodeRecord(user)
+
+	raw, ok := encoded.(esreindexer.RawRecord)
+	if !ok {
+		t.Fatalf("expected RawRecord, got %T", encoded)
+	}
+
+	if raw.GetIndex() != user.GetIndex() || raw.GetType() != user.GetType() || raw.GetId() != 10 {
+		t.Errorf("metadata isn't kept: %+v", raw)
+	}
+
+	if size != len(raw.Source)+bulkActionLineOverhead {
+		t.Errorf("size %d doesn't match encoded source of %d bytes", size, len(raw.Source))
+	}
+
+	deleted, size := encodeRecord(esreindexer.NewDeletedRecord("users", "users", 11))
+	if !esreindexer.IsDeleted(deleted) || size != bulkActionLineOverhead {
+		t.Errorf("deleted record must stay deleted without source, got %+v with size %d", deleted, size)
+	}
+}
+
+// Record whose search data can't be marshalled
+type unmarshallableRecord struct {
+	esreindexer.RawRecord
+}
+
+func (this unmarshallableRecord) GetSearchData() interface{} {
+	return math.Inf(1)
+}
+
+func TestWriteBatchDeadLettersUnencodableRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "es-reindexer")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "dead-letters.ndjson")
+
+	sink := &recordingSink{}
+	deadLetters := newDeadLetterWriter(path)
+	processor := newProcessor(sink, deadLetters, nil, newFatalError(func() {}), esreindexer.ElasticSearchConfig{Limit: 10})
+
+	unencodable, size := encodeRecord(unmarshallableRecord{newTestRecord(2, 10)})
+	if size != bulkActionLineOverhead {
+		t.Errorf("unexpected size %d", size)
+	}
+
+	err = processor.writeBatch(context.Background(), []esreindexer.FetchedRecord{newTestRecord(1, 10), unencodable})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadLetters.Close()
+
+	if len(sink.batches) != 1 || len(sink.batches[0]) != 1 || sink.batches[0][0].GetId() != 1 {
+		t.Errorf("only encoded record must be sent, got %v", sink.batches)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var letter deadLetter
+
+	err = json.Unmarshal(data, &letter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if letter.Id != 2 || !strings.HasPrefix(letter.Error, "serialization_error: ") {
+		t.Errorf("unexpected dead letter %s", data)
+	}
+}
+
+func TestDispatchRecordsKeepsOrderOfId(t *testing.T) {
+	records := make(chan esreindexer.FetchedRecord, 30)
+	workers := make([]chan esreindexer.FetchedRecord, 4)
+	for i := range workers {
+		workers[i] = make(chan esreindexer.FetchedRecord, 30)
+	}
+
+	// Three versions of every id, version is the size of source
+	for version := 1; version <= 3; version++ {
+		for id := uint64(1); id <= 10; id++ {
+			records <- newTestRecord(id, version+2)
+		}
+	}
+
+	close(records)
+	dispatchRecords(records, workers)
+
+	seen := map[uint64]int{}
+	workerOf := map[uint64]int{}
+
+	for i, worker := range workers {
+		for record := range worker {
+			id := record.GetId()
+
+			if previous, ok := workerOf[id]; ok && previous != i {
+				t.Errorf("id %d went to workers %d and %d", id, previous, i)
+			}
+
+			workerOf[id] = i
+
+			version := len(record.(esreindexer.RawRecord).Source) - 2
+			if version != seen[id]+1 {
+				t.Errorf("id %d: expected version %d, got %d", id, seen[id]+1, version)
+			}
+
+			seen[id] = version
+		}
+	}
+
+	if len(seen) != 10 {
+		t.Errorf("expected 10 ids, got %d", len(seen))
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright 2016-present InterPals. All Rights Reserved.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	esreindexer "github.com/interpals/es-reindexer"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+)
+
+const defaultProgressInterval = 10 * time.Second
+
+// Progress of partition or of the whole model, counts are records of this run
+type progressEstimate struct {
+	Total   uint64  `json:"total"`
+	Done    uint64  `json:"done"`
+	Percent float64 `json:"percent"`
+
+	// Acknowledged records per second
+	Rate float64 `json:"rate"`
+	Eta  string  `json:"eta,omitempty"`
+}
+
+func newProgressEstimate(total uint64, done uint64, elapsed time.Duration) progressEstimate {
+	estimate := progressEstimate{
+		Total: total,
+		Done:  done,
+	}
+
+	// Records are counted before fetch, so new ones can make done greater than total
+	if done > total {
+		estimate.Total = done
+	}
+
+	if estimate.Total > 0 {
+		estimate.Percent = float64(done) * 100 / float64(estimate.Total)
+	} else {
+		estimate.Percent = 100
+	}
+
+	if elapsed > 0 {
+		estimate.Rate = float64(done) / elapsed.Seconds()
+	}
+
+	if estimate.Rate > 0 {
+		left := time.Duration(float64(estimate.Total-done) / estimate.Rate * float64(time.Second))
+		estimate.Eta = left.Round(time.Second).String()
+	}
+
+	return estimate
+}
+
+// Counts records of full reindex upfront and reports progress of partitions periodically.
+// Done records are the acknowledged ones, so progress shows what is already in the index.
+type progressReporter struct {
+	checkpoints *checkpointTracker
+	started     time.Time
+	log         *logrus.Entry
+
+	mutex sync.Mutex
+
+	// Records left by partition, nil until all partitions are counted
+	totals map[string]uint64
+}
+
+func newProgressReporter(checkpoints *checkpointTracker, log *logrus.Entry) *progressReporter {
+	return &progressReporter{
+		checkpoints: checkpoints,
+		started:     time.Now(),
+		log:         log.WithField("component", "progress"),
+	}
+}
+
+func (this *progressReporter) count(
+	ctx context.Context,
+	db *gorm.DB,
+	source CountSource,
+	configuration esreindexer.DataBaseConfig) error {
+
+	threads := uint64(configuration.Threads)
+
+	totals := map[string]uint64{}
+	errs := make([]error, threads)
+
+	var (
+		mutex sync.Mutex
+		wg    *sync.WaitGroup = new(sync.WaitGroup)
+	)
+
+	for i := uint64(0); i < threads; i++ {
+		wg.Add(1)
+
+		go func(threadNumber uint64) {
+			defer wg.Done()
+
+			counts, err := source.Count(ctx, db.New(), this.checkpoints, threads, threadNumber, configuration)
+			if err != nil {
+				errs[threadNumber] = err
+				return
+			}
+
+			mutex.Lock()
+			for partition, count := range counts {
+				totals[partition] = count
+			}
+			mutex.Unlock()
+		}(i)
+	}
+
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	this.mutex.Lock()
+	this.totals = totals
+	this.mutex.Unlock()
+
+	return nil
+}
+
+// Estimates by partition and of the whole model, nil before partitions are counted
+func (this *progressReporter) Estimates() (map[string]progressEstimate, *progressEstimate) {
+	this.mutex.Lock()
+	totals := this.totals
+	this.mutex.Unlock()
+
+	if totals == nil {
+		return nil, nil
+	}
+
+	var (
+		elapsed   = time.Since(this.started)
+		progress  = this.checkpoints.Progress()
+		estimates = map[string]progressEstimate{}
+
+		total, done uint64
+	)
+
+	for partition, count := range totals {
+		acknowledged := progress[partition].Acknowledged
+
+		estimates[partition] = newProgressEstimate(count, acknowledged, elapsed)
+
+		total += count
+		done += acknowledged
+	}
+
+	all := newProgressEstimate(total, done, elapsed)
+
+	return estimates, &all
+}
+
+func (this *progressReporter) logEstimate(entry *logrus.Entry, estimate progressEstimate) {
+	eta := estimate.Eta
+	if eta == "" {
+		eta = "unknown"
+	}
+
+	entry.WithFields(logrus.Fields{
+		"total":   estimate.Total,
+		"done":    estimate.Done,
+		"percent": fmt.Sprintf("%.1f", estimate.Percent),
+		"rate":    fmt.Sprintf("%.0f", estimate.Rate),
+		"eta":     eta,
+	}).Info("Progress")
+}
+
+func (this *progressReporter) Log() {
+	estimates, all := this.Estimates()
+	if all == nil {
+		return
+	}
+
+	partitions := make([]string, 0, len(estimates))
+	for partition := range estimates {
+		partitions = append(partitions, partition)
+	}
+
+	sort.Strings(partitions)
+
+	for _, partition := range partitions {
+		this.logEstimate(this.log.WithField("partition", partition), estimates[partition])
+	}
+
+	this.logEstimate(this.log, *all)
+}
+
+// Counts partitions and logs progress every interval until ctx is cancelled.
+// Failed count only disables progress, it doesn't stop the run.
+func (this *progressReporter) Run(
+	ctx context.Context,
+	db *gorm.DB,
+	source CountSource,
+	configuration esreindexer.DataBaseConfig,
+	interval time.Duration) {
+
+	err := this.count(ctx, db, source, configuration)
+	if err != nil {
+		if ctx.Err() == nil {
+			this.log.WithError(err).Warn("Cannot count records, progress is disabled")
+		}
+
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			this.Log()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2016-present InterPals. All Rights Reserved.
+
+package main
+
+import (
+	"context"
+	"io"
+	"strconv"
+
+	esreindexer "github.com/interpals/es-reindexer"
+	"github.com/jinzhu/gorm"
+	"github.com/olivere/elastic"
+	"github.com/sirupsen/logrus"
+)
+
+// How long Elasticsearch keeps scroll between pages
+const scrollKeepAlive = "5m"
+
+// Scrolls ids of all documents of the index by pages, documents with not numeric ids are skipped
+func scrollIds(
+	ctx context.Context,
+	client *elastic.Client,
+	index string,
+	size int,
+	page func(ids []uint64, types map[uint64]string) error) error {
+
+	scroll := client.Scroll(index).
+		Query(elastic.NewMatchAllQuery()).
+		FetchSource(false).
+		Size(size).
+		KeepAlive(scrollKeepAlive)
+
+	defer scroll.Clear(context.Background())
+
+	for ctx.Err() == nil {
+		result, err := scroll.Do(ctx)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		var ids []uint64
+		types := map[uint64]string{}
+
+		for _, hit := range result.Hits.Hits {
+			id, err := strconv.ParseUint(hit.Id, 10, 64)
+			if err != nil {
+				loggerFromContext(ctx).WithFields(logrus.Fields{"component": "es", "id": hit.Id, "index": index}).Warn("Skip document with not numeric id")
+				continue
+			}
+
+			ids = append(ids, id)
+			types[id] = hit.Type
+		}
+
+		err = page(ids, types)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Sends deletions of documents which are in the index, but not in the database anymore.
+// It's a set difference of the index and the database, so it finds documents which were indexed
+// by previous runs too. Stale ids are checked by pages of the scroll.
+func pruneIndex(
+	ctx context.Context,
+	client *elastic.Client,
+	db *gorm.DB,
+	channel chan esreindexer.FetchedRecord,
+	index string,
+	configuration esreindexer.DataBaseConfig,
+	source PruneSource) error {
+
+	var checked, deleted uint64
+
+	err := scrollIds(ctx, client, index, int(configuration.Limit), func(ids []uint64, types map[uint64]string) error {
+		stale, err := source.Stale(ctx, db, configuration, ids)
+		if err != nil {
+			return err
+		}
+
+		for _, id := range stale {
+			// Index of the source, sink replaces alias by the rebuilt generation itself
+			if !sendRecord(ctx, channel, esreindexer.NewDeletedRecord(source.Index(), types[id], id)) {
+				return nil
+			}
+		}
+
+		checked += uint64(len(ids))
+		deleted += uint64(len(stale))
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	loggerFromContext(ctx).WithFields(logrus.Fields{"component": "es", "index": index, "checked": checked, "deleted": deleted}).Info("Prune finished")
+
+	return nil
+}
+
+func startPrune(
+	ctx context.Context,
+	fatal *fatalError,
+	client *elastic.Client,
+	db *gorm.DB,
+	eschan chan esreindexer.FetchedRecord,
+	index string,
+	configuration esreindexer.DataBaseConfig,
+	source PruneSource) {
+
+	err := pruneIndex(ctx, client, db, eschan, index, configuration, source)
+	if err != nil {
+		loggerFromContext(ctx).WithError(err).Error("Prune failed")
+		fatal.Report(err)
+	}
+}
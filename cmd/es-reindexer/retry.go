@@ -0,0 +1,225 @@
+// Copyright 2016-present InterPals. All Rights Reserved.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+
+	mysqldriver "github.com/go-sql-driver/mysql"
+	esreindexer "github.com/interpals/es-reindexer"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultRetryAttempts  = 5
+	defaultRetryBaseDelay = 500 * time.Millisecond
+	defaultRetryMaxDelay  = 30 * time.Second
+)
+
+// Error which must not be retried, for example invalid request
+type permanentError struct {
+	err error
+}
+
+func (this permanentError) Error() string {
+	return this.err.Error()
+}
+
+func permanent(err error) error {
+	return permanentError{err: err}
+}
+
+// Delay before the next attempt, attempt starts from 1
+func retryDelay(policy esreindexer.RetryConfig, attempt uint) time.Duration {
+	baseDelay := defaultRetryBaseDelay
+	if policy.BaseDelay > 0 {
+		baseDelay = time.Duration(policy.BaseDelay) * time.Millisecond
+	}
+
+	maxDelay := defaultRetryMaxDelay
+	if policy.MaxDelay > 0 {
+		maxDelay = time.Duration(policy.MaxDelay) * time.Millisecond
+	}
+
+	// Doubled until it reaches maxDelay, so large attempts don't overflow
+	delay := baseDelay
+	for i := uint(1); i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+
+	if policy.Jitter > 0 {
+		delay += time.Duration((rand.Float64()*2 - 1) * policy.Jitter * float64(delay))
+	}
+
+	return delay
+}
+
+// Runs operation until it succeeds, returns permanent error or attempts are exhausted.
+// Waiting between attempts is interrupted by ctx.
+func retry(ctx context.Context, policy esreindexer.RetryConfig, name string, operation func() error) error {
+	attempts := uint(defaultRetryAttempts)
+	if policy.Attempts > 0 {
+		attempts = uint(policy.Attempts)
+	}
+
+	var err error
+
+	for attempt := uint(1); ; attempt++ {
+		err = operation()
+		if err == nil {
+			return nil
+		}
+
+		if permanentErr, ok := err.(permanentError); ok {
+			return permanentErr.err
+		}
+
+		if attempt >= attempts {
+			break
+		}
+
+		delay := retryDelay(policy, attempt)
+		loggerFromContext(ctx).WithFields(logrus.Fields{
+			"component": "retry",
+			"operation": name,
+			"attempt":   attempt,
+			"attempts":  attempts,
+			"delay":     delay,
+		}).WithError(err).Warn("Attempt failed")
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+
+	return err
+}
+
+// MySQL errors of overloaded or restarting server, the rest like syntax errors fail the same way again
+var retryableMysqlErrors = map[uint16]bool{
+	1040: true, // Too many connections
+	1053: true, // Server shutdown in progress
+	1205: true, // Lock wait timeout exceeded
+	1213: true, // Deadlock found
+	1317: true, // Query execution was interrupted
+	3024: true, // Query execution time exceeded
+}
+
+// PostgreSQL error classes of connection problems, conflicts of transactions and lack of resources
+var retryablePostgresClasses = map[pq.ErrorClass]bool{
+	"08": true,
+	"40": true,
+	"53": true,
+	"57": true,
+}
+
+// Connection errors, timeouts, deadlocks and overloaded server are worth to retry
+func isRetryableDbError(err error) bool {
+	if err == driver.ErrBadConn || err == mysqldriver.ErrInvalidConn || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+
+	switch dbErr := err.(type) {
+	case *mysqldriver.MySQLError:
+		return retryableMysqlErrors[dbErr.Number]
+	case *pq.Error:
+		return retryablePostgresClasses[dbErr.Code.Class()]
+	case net.Error:
+		return true
+	}
+
+	// Unknown errors are retried like unknown errors of Elasticsearch
+	return true
+}
+
+func retryableDbError(err error) error {
+	if err == nil || isRetryableDbError(err) {
+		return err
+	}
+
+	return permanent(err)
+}
+
+// Runs query which returns a single number
+func queryCount(ctx context.Context, db *gorm.DB, configuration esreindexer.DataBaseConfig, query string, args ...interface{}) (uint64, error) {
+	var count uint64
+
+	err := queryPage(ctx, db, configuration, query, func(rows *sql.Rows) (int, error) {
+		if !rows.Next() {
+			return 0, nil
+		}
+
+		return 1, rows.Scan(&count)
+	}, args...)
+
+	return count, err
+}
+
+// Runs query and reads all its rows, the whole page is retried on error.
+// scan returns number of read rows, it's used by throttle of the context. args are bound to placeholders of query.
+func queryPage(
+	ctx context.Context,
+	db *gorm.DB,
+	configuration esreindexer.DataBaseConfig,
+	query string,
+	scan func(rows *sql.Rows) (int, error),
+	args ...interface{}) error {
+
+	throttle := throttleFromContext(ctx)
+
+	var count int
+
+	// Every query starts a page, so paused fetch stops at page boundary
+	fetchPause.Wait(ctx)
+
+	err := retry(ctx, configuration.Retry, "[DB] Query", func() error {
+		throttle.WaitQuery(ctx)
+
+		started := time.Now()
+		defer func() {
+			dbQueryDuration.WithLabelValues(fetchModelFromContext(ctx)).Observe(time.Since(started).Seconds())
+		}()
+
+		rows, err := db.Raw(query, args...).Rows()
+		if err != nil {
+			return retryableDbError(err)
+		}
+
+		defer rows.Close()
+
+		count, err = scan(rows)
+		if err != nil {
+			// Reading of rows fails on broken connection, otherwise values can't be converted
+			if rowsErr := rows.Err(); rowsErr != nil {
+				return retryableDbError(rowsErr)
+			}
+
+			return permanent(err)
+		}
+
+		return retryableDbError(rows.Err())
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// Waiting for the rows after the connection is released delays the next query of the model
+	throttle.WaitRows(ctx, count)
+
+	return nil
+}
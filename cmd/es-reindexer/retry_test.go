@@ -0,0 +1,72 @@
+// Copyright 2016-present InterPals. All Rights Reserved.
+
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"testing"
+	"time"
+
+	mysqldriver "github.com/go-sql-driver/mysql"
+	esreindexer "github.com/interpals/es-reindexer"
+	"github.com/lib/pq"
+)
+
+func TestRetryDelay(t *testing.T) {
+	policy := esreindexer.RetryConfig{BaseDelay: 1000, MaxDelay: 60000}
+
+	tests := []struct {
+		attempt uint
+		delay   time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{6, 32 * time.Second},
+		{7, time.Minute},
+		{40, time.Minute},
+		{200, time.Minute},
+	}
+
+	for _, test := range tests {
+		delay := retryDelay(policy, test.attempt)
+		if delay != test.delay {
+			t.Errorf("attempt %d: expected %s, got %s", test.attempt, test.delay, delay)
+		}
+	}
+}
+
+func TestRetryDelayOfLargeBaseDelay(t *testing.T) {
+	policy := esreindexer.RetryConfig{BaseDelay: 60000, MaxDelay: 4294967295}
+
+	for attempt := uint(1); attempt < 64; attempt++ {
+		delay := retryDelay(policy, attempt)
+		if delay <= 0 || delay > time.Duration(policy.MaxDelay)*time.Millisecond {
+			t.Fatalf("attempt %d: delay %s is out of range", attempt, delay)
+		}
+	}
+}
+
+func TestIsRetryableDbError(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		retryable bool
+	}{
+		{"bad connection", driver.ErrBadConn, true},
+		{"invalid connection", mysqldriver.ErrInvalidConn, true},
+		{"deadlock", &mysqldriver.MySQLError{Number: 1213}, true},
+		{"syntax error", &mysqldriver.MySQLError{Number: 1064}, false},
+		{"unknown column", &mysqldriver.MySQLError{Number: 1054}, false},
+		{"postgres connection failure", &pq.Error{Code: "08006"}, true},
+		{"postgres serialization failure", &pq.Error{Code: "40001"}, true},
+		{"postgres syntax error", &pq.Error{Code: "42601"}, false},
+		{"unknown", errors.New("unknown"), true},
+	}
+
+	for _, test := range tests {
+		if isRetryableDbError(test.err) != test.retryable {
+			t.Errorf("%s: expected retryable %t", test.name, test.retryable)
+		}
+	}
+}
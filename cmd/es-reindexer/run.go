@@ -0,0 +1,512 @@
+// Copyright 2016-present InterPals. All Rights Reserved.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	esreindexer "github.com/interpals/es-reindexer"
+	"github.com/jinzhu/gorm"
+	"github.com/olivere/elastic"
+	"github.com/sirupsen/logrus"
+)
+
+// Run was stopped by signal before it finished
+var errInterrupted = errors.New("interrupted")
+
+// What a single run does, it's built from command line or from daemon job
+type runOptions struct {
+	// Name of daemon job, empty for command line
+	job string
+
+	// Model, "<model>-delta", "<model>-stream" or "replay-dlq"
+	command string
+
+	// Dead-letter file of replay-dlq (configured one by default), model of verify and export,
+	// or directory of import
+	argument string
+
+	// Directory of export
+	dir string
+
+	field         string
+	maxTotalFetch uint64
+	resume        bool
+	rebuild       bool
+
+	// Verify fixes differences
+	repair bool
+
+	// Bulk bodies are written into files instead of Elasticsearch, client isn't used
+	dryRun bool
+}
+
+// Database connections by DSN key, opened on the first use and shared by runs of daemon
+type databases struct {
+	mutex         sync.Mutex
+	configuration esreindexer.DataBaseConfig
+	opened        map[string]*gorm.DB
+}
+
+func newDatabases(configuration esreindexer.DataBaseConfig) *databases {
+	return &databases{
+		configuration: configuration,
+		opened:        map[string]*gorm.DB{},
+	}
+}
+
+func (this *databases) Get(key string) (*gorm.DB, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if db, ok := this.opened[key]; ok {
+		return db, nil
+	}
+
+	db, err := gorm.Open(this.configuration.Dialect, this.configuration.GetUri(key))
+	if err != nil {
+		return nil, err
+	}
+
+	db.SetLogger(gormLogger{entry: logger.WithField("dsn", key)})
+	db.LogMode(this.configuration.ShowLog)
+	db.DB().SetMaxIdleConns(this.configuration.MaxIdleConnections)
+	db.DB().SetMaxOpenConns(this.configuration.MaxOpenConnections)
+
+	this.opened[key] = db
+
+	return db, nil
+}
+
+// Checks connections which are opened, pings don't block Get of runs
+func (this *databases) Ping() error {
+	this.mutex.Lock()
+
+	opened := make([]*gorm.DB, 0, len(this.opened))
+	for _, db := range this.opened {
+		opened = append(opened, db)
+	}
+
+	this.mutex.Unlock()
+
+	for _, db := range opened {
+		err := db.DB().Ping()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (this *databases) Close() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	for key, db := range this.opened {
+		db.Close()
+		delete(this.opened, key)
+	}
+}
+
+func usageError() error {
+	return fmt.Errorf("Usage: es-reindexer [%s]", strings.Join(append(sourceCommands(), "replay-dlq", "create-index", "verify", "export", "import", "daemon"), "|"))
+}
+
+// Context of fetch goroutines of the model, they share the throttle with other runs of the model
+func newFetchContext(ctx context.Context, config esreindexer.Configuration, source Source) (context.Context, error) {
+	throttle, err := modelFetchThrottle(source.Name(), config.DataBase.Throttle[source.Name()])
+	if err != nil {
+		return nil, err
+	}
+
+	if throttle != nil {
+		loggerFromContext(ctx).WithField("component", "db").Info("Fetch is throttled")
+	}
+
+	return withFetchModel(withThrottle(ctx, throttle), source.Name()), nil
+}
+
+// Fetches records of the command and writes them into Elasticsearch.
+// Fetch stops when ctx is cancelled, but processing isn't interrupted to flush everything what was fetched,
+// errInterrupted is returned then.
+func run(
+	ctx context.Context,
+	client *elastic.Client,
+	dbs *databases,
+	config esreindexer.Configuration,
+	options runOptions) error {
+
+	command := options.command
+
+	ctx = withLogger(ctx, loggerFromContext(ctx).WithFields(logrus.Fields{"run": newRunId(), "command": command}))
+
+	counters := &runCounters{}
+	ctx = withRunCounters(ctx, counters)
+
+	if (options.resume || options.rebuild) &&
+		(command == "replay-dlq" || command == "verify" || command == "export" || command == "import" || strings.HasSuffix(command, "-delta") || strings.HasSuffix(command, "-stream")) {
+		return errors.New("-resume and -rebuild are supported only by full reindex")
+	}
+
+	if options.dryRun && (options.rebuild || command == "verify") {
+		return errors.New("-dry-run doesn't support -rebuild and verify, they need Elasticsearch")
+	}
+
+	// Export doesn't write into Elasticsearch, so it doesn't need processing
+	if command == "export" {
+		if options.dryRun {
+			return errors.New("-dry-run isn't supported by export")
+		}
+
+		return runExport(ctx, dbs, config, options.argument, options.dir)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	fatal := newFatalError(cancel)
+
+	// Mapping files of new index generations are converted to the format too
+	format, err := newDocumentFormat(ctx, client, config.ElasticSearch)
+	if err != nil {
+		return err
+	}
+
+	var (
+		fetch       func(channel chan esreindexer.FetchedRecord)
+		checkpoints *checkpointTracker
+
+		// Watermark of delta sync is kept after successful run, checkpoint of full reindex is removed
+		keepCheckpoints bool
+
+		// Stream runs until signal, so interruption is its normal end
+		streaming bool
+
+		// Dead-letter file which is replayed, it's removed after successful replay
+		replayPath string
+
+		// Progress of full reindex, when the source can count its records
+		progress *progressReporter
+
+		// Alias which is moved to the new index generation after successful rebuild
+		rebuildAlias string
+		indices      = map[string]string{}
+	)
+
+	if command == "replay-dlq" {
+		path := options.argument
+		if path == "" {
+			path = config.GetDeadLetterFile()
+		}
+
+		// Dry run only reads the file, it's taken aside and removed by real replay
+		source := path
+
+		if !options.dryRun {
+			replayPath, err = takeDeadLetters(path)
+			if err != nil {
+				return err
+			}
+
+			source = replayPath
+		}
+
+		loggerFromContext(ctx).WithField("path", source).Info("Replay dead letters")
+
+		fetch = func(channel chan esreindexer.FetchedRecord) {
+			replayDeadLetters(ctx, fatal, source, channel)
+		}
+	} else if command == "import" {
+		if options.argument == "" {
+			return fmt.Errorf("Usage: es-reindexer import <dir>")
+		}
+
+		var paths []string
+
+		paths, err = exportFiles(options.argument)
+		if err != nil {
+			return err
+		}
+
+		loggerFromContext(ctx).WithFields(logrus.Fields{"files": len(paths), "dir": options.argument}).Info("Import files")
+
+		fetch = func(channel chan esreindexer.FetchedRecord) {
+			startImport(ctx, fatal, paths, channel)
+		}
+	} else if command == "verify" {
+		source, ok := lookupSource(options.argument)
+		if !ok {
+			return fmt.Errorf("Usage: es-reindexer [-repair] verify <model>")
+		}
+
+		ctx = withLogger(ctx, loggerFromContext(ctx).WithField("model", source.Name()))
+
+		verifySource, ok := source.(VerifySource)
+		if !ok {
+			return fmt.Errorf("verify isn't supported by %s", source.Name())
+		}
+
+		err = source.Validate(config)
+		if err != nil {
+			return err
+		}
+
+		var db *gorm.DB
+
+		db, err = dbs.Get(source.DataBaseUriKey())
+		if err != nil {
+			return err
+		}
+
+		fetch = func(channel chan esreindexer.FetchedRecord) {
+			startVerify(ctx, fatal, client, db, channel, source.Index(), config.DataBase, verifySource, options.repair)
+		}
+	} else {
+		model := strings.TrimSuffix(strings.TrimSuffix(command, "-delta"), "-stream")
+		delta := strings.HasSuffix(command, "-delta")
+		stream := strings.HasSuffix(command, "-stream")
+
+		source, ok := lookupSource(model)
+		if ok && delta {
+			_, ok = source.(DeltaSource)
+		}
+
+		if ok && stream {
+			_, ok = source.(StreamSource)
+		}
+
+		if !ok {
+			return usageError()
+		}
+
+		ctx = withLogger(ctx, loggerFromContext(ctx).WithField("model", source.Name()))
+
+		err = source.Validate(config)
+		if err != nil {
+			return err
+		}
+
+		if delta {
+			err = source.(DeltaSource).ValidateDelta(options.field, options.maxTotalFetch)
+			if err != nil {
+				return err
+			}
+		}
+
+		var fetchCtx context.Context
+
+		fetchCtx, err = newFetchContext(ctx, config, source)
+		if err != nil {
+			return err
+		}
+
+		var db *gorm.DB
+
+		db, err = dbs.Get(source.DataBaseUriKey())
+		if err != nil {
+			return err
+		}
+
+		if delta {
+			loggerFromContext(ctx).WithFields(logrus.Fields{"field": options.field, "total": options.maxTotalFetch}).Info("Delta sync")
+
+			checkpoints, err = loadWatermarkTracker(watermarkPath(config, source.Name(), options.field), source.Name())
+			if err != nil {
+				return err
+			}
+
+			keepCheckpoints = true
+
+			fetch = func(channel chan esreindexer.FetchedRecord) {
+				startFetchDelta(fetchCtx, fatal, db, channel, checkpoints, config.DataBase, source.(DeltaSource), options.field, options.maxTotalFetch)
+			}
+		} else if stream {
+			path := streamPositionPath(config, source.Name())
+
+			checkpoints, err = loadWatermarkTracker(path, source.Name())
+			if err != nil {
+				return err
+			}
+
+			keepCheckpoints = true
+			streaming = true
+
+			fetch = func(channel chan esreindexer.FetchedRecord) {
+				startStream(fetchCtx, fatal, db, channel, checkpoints, config.DataBase, source.(StreamSource))
+			}
+		} else {
+			path := checkpointPath(config, source.Name())
+
+			if options.resume {
+				checkpoints, err = resumeCheckpointTracker(path, source.Name(), config.DataBase.Threads)
+				if err != nil {
+					return err
+				}
+
+				loggerFromContext(ctx).WithField("path", path).Info("Resume from checkpoint")
+			} else {
+				checkpoints = newCheckpointTracker(path, source.Name(), config.DataBase.Threads)
+			}
+
+			if options.resume && (checkpoints.Index(source.Index()) != "") != options.rebuild {
+				return errors.New("-rebuild must be the same as in the interrupted run")
+			}
+
+			if options.rebuild {
+				rebuildAlias = source.Index()
+
+				index := checkpoints.Index(rebuildAlias)
+				if index == "" {
+					index, err = createIndexGeneration(ctx, client, rebuildAlias, config.ElasticSearch, format)
+					if err != nil {
+						return err
+					}
+
+					// Saved right away, so the new generation isn't lost if the run is interrupted
+					checkpoints.SetIndex(rebuildAlias, index)
+
+					err = checkpoints.Save()
+					if err != nil {
+						return err
+					}
+				}
+
+				loggerFromContext(ctx).WithFields(logrus.Fields{"alias": rebuildAlias, "index": index}).Info("Rebuild into new generation")
+				indices[rebuildAlias] = index
+			}
+
+			target := source.Index()
+			if index, ok := indices[target]; ok {
+				target = index
+			}
+
+			if countSource, ok := source.(CountSource); ok {
+				interval := defaultProgressInterval
+				if config.ProgressInterval > 0 {
+					interval = time.Duration(config.ProgressInterval) * time.Second
+				}
+
+				progressCtx, stopProgress := context.WithCancel(fetchCtx)
+				defer stopProgress()
+
+				progress = newProgressReporter(checkpoints, loggerFromContext(ctx))
+				go progress.Run(progressCtx, db, countSource, config.DataBase, interval)
+			}
+
+			fetch = func(channel chan esreindexer.FetchedRecord) {
+				startFetch(fetchCtx, fatal, db, channel, checkpoints, config.DataBase, source)
+
+				// Only complete fetch knows which documents are left
+				if pruneSource, ok := source.(PruneSource); ok && fetchCtx.Err() == nil && !options.dryRun {
+					startPrune(fetchCtx, fatal, client, db, channel, target, config.DataBase, pruneSource)
+				}
+
+				// No records, lets close channel to stop range query and send latest bulk request
+				close(channel)
+			}
+		}
+
+		// New generation is created from the mapping file, it's enough to check live indices
+		if !options.rebuild && !options.dryRun {
+			err = checkMapping(ctx, client, source.Index(), config.ElasticSearch, format)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Dry run must not move checkpoints, they are detached before the first page is tracked
+	if options.dryRun {
+		checkpoints.Detach()
+	}
+
+	fetchedRecords := make(chan esreindexer.FetchedRecord, config.ChannelBufferSize) // async channel
+	go fetch(fetchedRecords)
+
+	stopWatch := watchChannel(command, fetchedRecords)
+	defer stopWatch()
+
+	// Jobs of daemon can run the same command
+	name := options.job
+	if name == "" {
+		name = command
+	}
+
+	removeRun := activeRuns.Add(name, command, counters, checkpoints, progress)
+	defer removeRun()
+
+	var (
+		sink           Sink = newElasticSink(client, indices, format)
+		deadLetterFile      = config.GetDeadLetterFile()
+	)
+
+	if options.dryRun {
+		sink, err = newFileSink(config.DryRun, indices, format)
+		if err != nil {
+			return err
+		}
+
+		deadLetterFile = filepath.Join(dryRunDir(config.DryRun), "dead-letters.ndjson")
+	}
+
+	deadLetters := newDeadLetterWriter(deadLetterFile)
+	processor := newProcessor(sink, deadLetters, checkpoints, fatal, config.ElasticSearch)
+
+	startProcessing(withRunCounters(withLogger(context.Background(), loggerFromContext(ctx)), counters), processor, fetchedRecords)
+
+	if progress != nil {
+		progress.Log()
+	}
+
+	if deadLetters.Count() > 0 {
+		loggerFromContext(ctx).WithFields(logrus.Fields{"count": deadLetters.Count(), "path": deadLetterFile}).Warn("Dead letters are written")
+	}
+
+	if fatal.Err() != nil {
+		loggerFromContext(ctx).WithFields(logrus.Fields{"fetched": counters.Fetched(), "sent": counters.Sent()}).WithError(fatal.Err()).Error("Failed")
+		err = fatal.Err()
+	} else if ctx.Err() != nil && !streaming {
+		loggerFromContext(ctx).WithFields(logrus.Fields{"fetched": counters.Fetched(), "sent": counters.Sent()}).Warn("Interrupted")
+		err = errInterrupted
+	} else if replayPath != "" {
+		removeErr := os.Remove(replayPath)
+		if removeErr != nil {
+			loggerFromContext(ctx).WithError(removeErr).Warn("Cannot remove replayed dead letters")
+		}
+	}
+
+	if err == nil && rebuildAlias != "" {
+		err = finishRebuild(context.Background(), client, rebuildAlias, indices[rebuildAlias], config.ElasticSearch)
+	}
+
+	var checkpointErr error
+
+	if keepCheckpoints {
+		checkpointErr = checkpoints.Save()
+	} else if err == nil {
+		checkpointErr = checkpoints.Remove()
+	} else {
+		checkpointErr = checkpoints.Save()
+		if checkpointErr == nil && checkpoints != nil && !options.dryRun {
+			loggerFromContext(ctx).Info("Checkpoint is saved, run with -resume to continue")
+		}
+	}
+
+	if checkpointErr != nil {
+		loggerFromContext(ctx).WithError(checkpointErr).Error("Cannot save checkpoint")
+	}
+
+	if err != nil && replayPath != "" {
+		loggerFromContext(ctx).WithField("path", replayPath).Warn("Replay is not finished, rest of dead letters is kept")
+	}
+
+	return err
+}
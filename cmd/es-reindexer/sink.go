@@ -0,0 +1,38 @@
+// Copyright 2016-present InterPals. All Rights Reserved.
+
+package main
+
+import (
+	"context"
+
+	esreindexer "github.com/interpals/es-reindexer"
+)
+
+// Result of writing a single record into Sink
+type SinkItemResult struct {
+	Record esreindexer.FetchedRecord
+
+	// HTTP like status code of the item, 0 if Sink doesn't provide it
+	Status int
+
+	// Both are empty on success
+	ErrorType string
+	Error     string
+}
+
+func (this SinkItemResult) Failed() bool {
+	return this.ErrorType != "" || this.Error != ""
+}
+
+// Sink is a destination of fetched records, for example Elasticsearch bulk API.
+// Sink is shared between all processing goroutines, so it must be safe for concurrent use.
+type Sink interface {
+	// Write sends batch of records, result contains one item per record in the same order.
+	// Error is returned only when the whole batch failed.
+	Write(ctx context.Context, records []esreindexer.FetchedRecord) ([]SinkItemResult, error)
+
+	// Flush is called when there are no more records to write
+	Flush() error
+
+	Close() error
+}
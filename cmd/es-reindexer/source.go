@@ -0,0 +1,197 @@
+// Copyright 2016-present InterPals. All Rights Reserved.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	esreindexer "github.com/interpals/es-reindexer"
+	"github.com/jinzhu/gorm"
+)
+
+// Source fetches records of one model from the database.
+// Fetching is partitioned: every thread fetches only the records of its own partition.
+type Source interface {
+	// Name of the model, it's used as the command name too
+	Name() string
+
+	// Index (or alias, when it's rebuilt into a new generation) which records are written to
+	Index() string
+
+	// DataBaseUriKey is a key of the DSN inside "db" section of the config, for example "uri-geo"
+	DataBaseUriKey() string
+
+	Validate(configuration esreindexer.Configuration) error
+
+	// Fetch must stop paging as soon as ctx is cancelled, error is returned when retries are exhausted.
+	// Partitions continue from ids of checkpoints and pages are sent through sendPage.
+	Fetch(
+		ctx context.Context,
+		db *gorm.DB,
+		channel chan esreindexer.FetchedRecord,
+		checkpoints *checkpointTracker,
+		numberOfThread uint64,
+		threadNumber uint64,
+		configuration esreindexer.DataBaseConfig) error
+}
+
+// DeltaSource is a Source which supports "<name>-delta" command
+type DeltaSource interface {
+	Source
+
+	ValidateDelta(field string, maxTotalFetch uint64) error
+
+	// Records are fetched after the watermark of checkpoints, pages move it when they are acknowledged
+	FetchDelta(
+		ctx context.Context,
+		db *gorm.DB,
+		channel chan esreindexer.FetchedRecord,
+		checkpoints *checkpointTracker,
+		configuration esreindexer.DataBaseConfig,
+		field string,
+		maxTotalFetch uint64) error
+}
+
+// StreamSource is a Source which supports "<name>-stream" command, it follows changes until ctx is cancelled.
+// Position of the stream is kept as watermark of checkpoints and moved when records are acknowledged.
+type StreamSource interface {
+	Source
+
+	Stream(
+		ctx context.Context,
+		db *gorm.DB,
+		channel chan esreindexer.FetchedRecord,
+		checkpoints *checkpointTracker,
+		configuration esreindexer.DataBaseConfig) error
+}
+
+// VerifySource is a Source which can list ids of records that must be in the index.
+// Ids are fetched by the same partitions as Fetch does, partition of id is id % numberOfThread.
+type VerifySource interface {
+	Source
+
+	FetchIds(
+		ctx context.Context,
+		db *gorm.DB,
+		numberOfThread uint64,
+		threadNumber uint64,
+		configuration esreindexer.DataBaseConfig,
+		page func(ids []uint64) error) error
+
+	// Records by ids, ids which must not be in the index are returned as deletions
+	FetchByIds(
+		ctx context.Context,
+		db *gorm.DB,
+		configuration esreindexer.DataBaseConfig,
+		ids []uint64) ([]esreindexer.FetchedRecord, error)
+}
+
+// PruneSource is a Source which can find documents that aren't in the database anymore,
+// they are deleted from the index after full reindex
+type PruneSource interface {
+	Source
+
+	// Returns ids which must be deleted of the given ids of indexed documents
+	Stale(ctx context.Context, db *gorm.DB, configuration esreindexer.DataBaseConfig, ids []uint64) ([]uint64, error)
+}
+
+// CountSource is a Source which can count records before full reindex, counts are used for progress and ETA
+type CountSource interface {
+	Source
+
+	// Number of records left after checkpoints by partition key, for the partitions of threadNumber
+	Count(
+		ctx context.Context,
+		db *gorm.DB,
+		checkpoints *checkpointTracker,
+		numberOfThread uint64,
+		threadNumber uint64,
+		configuration esreindexer.DataBaseConfig) (map[string]uint64, error)
+}
+
+var sources = map[string]Source{}
+
+func registerSource(source Source) {
+	if _, ok := sources[source.Name()]; ok {
+		panic("Source " + source.Name() + " is already registered")
+	}
+
+	sources[source.Name()] = source
+}
+
+func lookupSource(name string) (Source, bool) {
+	source, ok := sources[name]
+	return source, ok
+}
+
+// List of supported commands, sorted
+func sourceCommands() []string {
+	var result []string
+
+	for name, source := range sources {
+		result = append(result, name)
+
+		if _, ok := source.(DeltaSource); ok {
+			result = append(result, name+"-delta")
+		}
+
+		if _, ok := source.(StreamSource); ok {
+			result = append(result, name+"-stream")
+		}
+	}
+
+	sort.Strings(result)
+
+	return result
+}
+
+// Checks the parts of configuration which are common for all sources
+func validateSourceConfiguration(source Source, configuration esreindexer.Configuration) error {
+	if configuration.DataBase.GetUri(source.DataBaseUriKey()) == "" {
+		return fmt.Errorf("db.%s must be configured for %s", source.DataBaseUriKey(), source.Name())
+	}
+
+	if configuration.DataBase.Threads == 0 {
+		return fmt.Errorf("db.threads must be greater than 0")
+	}
+
+	if configuration.DataBase.Limit == 0 {
+		return fmt.Errorf("db.limit must be greater than 0")
+	}
+
+	return nil
+}
+
+// Sends record to channel, returns false if ctx was cancelled before the record was accepted
+func sendRecord(ctx context.Context, channel chan esreindexer.FetchedRecord, record esreindexer.FetchedRecord) bool {
+	select {
+	case channel <- record:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Sends page of records, it's tracked for checkpoints first.
+// lastId is the id which partition continues from when the whole page is acknowledged.
+func sendPage(
+	ctx context.Context,
+	channel chan esreindexer.FetchedRecord,
+	checkpoints *checkpointTracker,
+	partition string,
+	lastId uint64,
+	page []esreindexer.FetchedRecord) bool {
+
+	checkpoints.Track(partition, lastId, page)
+	observeFetch(ctx, partition, len(page))
+
+	for _, record := range page {
+		if !sendRecord(ctx, channel, record) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,187 @@
+// Copyright 2016-present InterPals. All Rights Reserved.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	esreindexer "github.com/interpals/es-reindexer"
+)
+
+// Spreads units evenly in time, rate is asked on every reservation, so it can change by schedule
+type rateLimiter struct {
+	mutex sync.Mutex
+	next  time.Time
+}
+
+// Waits until n units can be used at the given rate per second, cancelled ctx stops waiting
+func (this *rateLimiter) Wait(ctx context.Context, n int, rate float64) {
+	if rate <= 0 || n <= 0 {
+		return
+	}
+
+	this.mutex.Lock()
+
+	now := time.Now()
+	if this.next.Before(now) {
+		this.next = now
+	}
+
+	start := this.next
+	this.next = this.next.Add(time.Duration(float64(n) / rate * float64(time.Second)))
+
+	this.mutex.Unlock()
+
+	delay := start.Sub(now)
+	if delay <= 0 {
+		return
+	}
+
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+	}
+}
+
+type throttleWindow struct {
+	from   time.Duration
+	to     time.Duration
+	factor float64
+}
+
+// Limits rows and queries per second of all fetch goroutines of a model.
+// nil throttle is valid and doesn't limit anything.
+type fetchThrottle struct {
+	rowsPerSecond    float64
+	queriesPerSecond float64
+	defaultFactor    float64
+	windows          []throttleWindow
+
+	rows    rateLimiter
+	queries rateLimiter
+}
+
+// Parses "HH:MM" into offset from midnight
+func parseTimeOfDay(value string) (time.Duration, error) {
+	parsed, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("time of day must be HH:MM, got %q", value)
+	}
+
+	return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+}
+
+func newFetchThrottle(configuration esreindexer.ThrottleConfig) (*fetchThrottle, error) {
+	if configuration.RowsPerSecond == 0 && configuration.QueriesPerSecond == 0 {
+		return nil, nil
+	}
+
+	throttle := &fetchThrottle{
+		rowsPerSecond:    float64(configuration.RowsPerSecond),
+		queriesPerSecond: float64(configuration.QueriesPerSecond),
+		defaultFactor:    1,
+	}
+
+	if configuration.DefaultFactor > 0 {
+		throttle.defaultFactor = configuration.DefaultFactor
+	}
+
+	for _, window := range configuration.Schedule {
+		from, err := parseTimeOfDay(window.From)
+		if err != nil {
+			return nil, err
+		}
+
+		to, err := parseTimeOfDay(window.To)
+		if err != nil {
+			return nil, err
+		}
+
+		if window.Factor <= 0 {
+			return nil, fmt.Errorf("factor of throttle window %s-%s must be greater than 0", window.From, window.To)
+		}
+
+		throttle.windows = append(throttle.windows, throttleWindow{
+			from:   from,
+			to:     to,
+			factor: window.Factor,
+		})
+	}
+
+	return throttle, nil
+}
+
+// Throttles of models, built on the first run of the model. They are shared by all runs of the process,
+// so concurrent daemon jobs of a model don't get the configured rates each.
+var (
+	fetchThrottlesMutex sync.Mutex
+	fetchThrottles      = map[string]*fetchThrottle{}
+)
+
+func modelFetchThrottle(model string, configuration esreindexer.ThrottleConfig) (*fetchThrottle, error) {
+	fetchThrottlesMutex.Lock()
+	defer fetchThrottlesMutex.Unlock()
+
+	if throttle, ok := fetchThrottles[model]; ok {
+		return throttle, nil
+	}
+
+	throttle, err := newFetchThrottle(configuration)
+	if err != nil {
+		return nil, err
+	}
+
+	fetchThrottles[model] = throttle
+
+	return throttle, nil
+}
+
+// Share of configured rates which is allowed at the moment, windows can wrap midnight
+func (this *fetchThrottle) factor(now time.Time) float64 {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	offset := now.Sub(midnight)
+
+	for _, window := range this.windows {
+		inside := offset >= window.from && offset < window.to
+		if window.from > window.to {
+			inside = offset >= window.from || offset < window.to
+		}
+
+		if inside {
+			return window.factor
+		}
+	}
+
+	return this.defaultFactor
+}
+
+func (this *fetchThrottle) WaitQuery(ctx context.Context) {
+	if this == nil {
+		return
+	}
+
+	this.queries.Wait(ctx, 1, this.queriesPerSecond*this.factor(time.Now()))
+}
+
+func (this *fetchThrottle) WaitRows(ctx context.Context, n int) {
+	if this == nil {
+		return
+	}
+
+	this.rows.Wait(ctx, n, this.rowsPerSecond*this.factor(time.Now()))
+}
+
+type throttleContextKey struct{}
+
+// Throttle is passed by context, because it's shared by all queries of the model
+func withThrottle(ctx context.Context, throttle *fetchThrottle) context.Context {
+	return context.WithValue(ctx, throttleContextKey{}, throttle)
+}
+
+func throttleFromContext(ctx context.Context) *fetchThrottle {
+	throttle, _ := ctx.Value(throttleContextKey{}).(*fetchThrottle)
+	return throttle
+}
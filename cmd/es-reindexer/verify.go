@@ -0,0 +1,209 @@
+// Copyright 2016-present InterPals. All Rights Reserved.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	esreindexer "github.com/interpals/es-reindexer"
+	"github.com/jinzhu/gorm"
+	"github.com/olivere/elastic"
+	"github.com/sirupsen/logrus"
+)
+
+// How many ids of differences are logged for every partition
+const verifyLoggedIds = 10
+
+// Comparison of one partition of the database and the index
+type partitionReport struct {
+	partition string
+
+	database uint64
+	index    uint64
+
+	// Ids which are in the database but not in the index
+	missing []uint64
+
+	// Ids which are in the index but not in the database
+	extra []uint64
+}
+
+func sortIds(ids []uint64) {
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+}
+
+func firstIds(ids []uint64) []uint64 {
+	if len(ids) > verifyLoggedIds {
+		return ids[:verifyLoggedIds]
+	}
+
+	return ids
+}
+
+// Compares ids of the database with ids of the index by partitions.
+// With repair missing records are sent to channel for indexing and extra ones for deletion,
+// without it differences are reported as error.
+func verifyIndex(
+	ctx context.Context,
+	client *elastic.Client,
+	db *gorm.DB,
+	channel chan esreindexer.FetchedRecord,
+	index string,
+	configuration esreindexer.DataBaseConfig,
+	source VerifySource,
+	repair bool) error {
+
+	threads := uint64(configuration.Threads)
+
+	// Type of indexed documents by id, by partitions
+	indexed := make([]map[uint64]string, threads)
+	for i := range indexed {
+		indexed[i] = map[uint64]string{}
+	}
+
+	err := scrollIds(ctx, client, index, int(configuration.Limit), func(ids []uint64, types map[uint64]string) error {
+		for _, id := range ids {
+			indexed[id%threads][id] = types[id]
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	reports := make([]partitionReport, threads)
+	errs := make([]error, threads)
+
+	var wg *sync.WaitGroup = new(sync.WaitGroup)
+
+	for i := uint64(0); i < threads; i++ {
+		wg.Add(1)
+
+		go func(threadNumber uint64) {
+			defer wg.Done()
+
+			report := &reports[threadNumber]
+			report.partition = partitionKey("", threadNumber)
+			report.index = uint64(len(indexed[threadNumber]))
+
+			// Ids found in the database are removed, the rest are extra
+			left := indexed[threadNumber]
+
+			errs[threadNumber] = source.FetchIds(ctx, db, threads, threadNumber, configuration, func(ids []uint64) error {
+				report.database += uint64(len(ids))
+
+				for _, id := range ids {
+					if _, ok := left[id]; ok {
+						delete(left, id)
+					} else {
+						report.missing = append(report.missing, id)
+					}
+				}
+
+				return nil
+			})
+
+			for id := range left {
+				report.extra = append(report.extra, id)
+			}
+
+			sortIds(report.extra)
+		}(i)
+	}
+
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	var total partitionReport
+
+	verifyLog := loggerFromContext(ctx).WithFields(logrus.Fields{"component": "verify", "index": index})
+
+	for _, report := range reports {
+		verifyLog.WithFields(logrus.Fields{
+			"partition":     report.partition,
+			"database":      report.database,
+			"index-count":   report.index,
+			"missing":       len(report.missing),
+			"missing-first": firstIds(report.missing),
+			"extra":         len(report.extra),
+			"extra-first":   firstIds(report.extra),
+		}).Info("Partition is compared")
+
+		total.database += report.database
+		total.index += report.index
+		total.missing = append(total.missing, report.missing...)
+		total.extra = append(total.extra, report.extra...)
+	}
+
+	verifyLog.WithFields(logrus.Fields{
+		"database":    total.database,
+		"index-count": total.index,
+		"missing":     len(total.missing),
+		"extra":       len(total.extra),
+	}).Info("Index is compared")
+
+	if len(total.missing) == 0 && len(total.extra) == 0 {
+		return nil
+	}
+
+	if !repair {
+		return fmt.Errorf("%s differs from database: %d missing, %d extra, run with -repair to fix", index, len(total.missing), len(total.extra))
+	}
+
+	records, err := source.FetchByIds(ctx, db, configuration, total.missing)
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		if !sendRecord(ctx, channel, record) {
+			return nil
+		}
+	}
+
+	for _, id := range total.extra {
+		if !sendRecord(ctx, channel, esreindexer.NewDeletedRecord(source.Index(), indexed[id%threads][id], id)) {
+			return nil
+		}
+	}
+
+	verifyLog.WithFields(logrus.Fields{"indexed": len(records), "deleted": len(total.extra)}).Info("Repair is sent")
+
+	return nil
+}
+
+func startVerify(
+	ctx context.Context,
+	fatal *fatalError,
+	client *elastic.Client,
+	db *gorm.DB,
+	eschan chan esreindexer.FetchedRecord,
+	index string,
+	configuration esreindexer.DataBaseConfig,
+	source VerifySource,
+	repair bool) {
+
+	err := verifyIndex(ctx, client, db, eschan, index, configuration, source, repair)
+	if err != nil {
+		loggerFromContext(ctx).WithError(err).Error("Verify failed")
+		fatal.Report(err)
+	}
+
+	close(eschan)
+}
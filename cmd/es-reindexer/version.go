@@ -0,0 +1,398 @@
+// Copyright 2016-present InterPals. All Rights Reserved.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	esreindexer "github.com/interpals/es-reindexer"
+	"github.com/olivere/elastic"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultTypeField       = "doc_type"
+	distributionOpenSearch = "opensearch"
+)
+
+type clusterVersion struct {
+	// Empty for Elasticsearch
+	Distribution string
+	Number       string
+	Major        int
+}
+
+// Version like "7.10.2" or "opensearch 2.11.0"
+func parseClusterVersion(version string) (clusterVersion, error) {
+	var result clusterVersion
+
+	parts := strings.Fields(strings.ToLower(version))
+	switch len(parts) {
+	case 1:
+		result.Number = parts[0]
+	case 2:
+		result.Distribution, result.Number = parts[0], parts[1]
+	default:
+		return result, fmt.Errorf("invalid version %q", version)
+	}
+
+	if result.Distribution == "elasticsearch" {
+		result.Distribution = ""
+	}
+
+	major, err := strconv.Atoi(strings.Split(result.Number, ".")[0])
+	if err != nil {
+		return result, fmt.Errorf("invalid version %q", version)
+	}
+
+	result.Major = major
+
+	return result, nil
+}
+
+// Mapping types are deprecated in Elasticsearch 7 and removed in 8, OpenSearch has no types at all
+func (this clusterVersion) Typeless() bool {
+	return this.Distribution == distributionOpenSearch || this.Major >= 7
+}
+
+func (this clusterVersion) String() string {
+	if this.Distribution == "" {
+		return this.Number
+	}
+
+	return this.Distribution + " " + this.Number
+}
+
+// Asks the root endpoint, OpenSearch reports its distribution there
+func detectClusterVersion(ctx context.Context, client *elastic.Client) (clusterVersion, error) {
+	response, err := client.PerformRequest(ctx, "GET", "/", nil, nil)
+	if err != nil {
+		return clusterVersion{}, err
+	}
+
+	var info struct {
+		Version struct {
+			Number       string `json:"number"`
+			Distribution string `json:"distribution"`
+		} `json:"version"`
+	}
+
+	err = json.Unmarshal(response.Body, &info)
+	if err != nil {
+		return clusterVersion{}, err
+	}
+
+	return parseClusterVersion(strings.TrimSpace(info.Version.Distribution + " " + info.Version.Number))
+}
+
+// How documents are addressed in bulk requests, it depends on version of the cluster
+type documentFormat struct {
+	typeless bool
+
+	// Document field with record type in typeless indices
+	typeField string
+
+	// Join fields by index (alias) name
+	joins map[string]joinField
+}
+
+// Join field of typeless index and its relations
+type joinField struct {
+	name      string
+	relations map[string][]string
+
+	// Types which have children, and which have a parent
+	parents  map[string]bool
+	children map[string]bool
+}
+
+func newJoinField(name string, relations map[string][]string) joinField {
+	join := joinField{
+		name:      name,
+		relations: relations,
+		parents:   map[string]bool{},
+		children:  map[string]bool{},
+	}
+
+	for parent, children := range relations {
+		join.parents[parent] = true
+
+		for _, child := range children {
+			join.children[child] = true
+		}
+	}
+
+	return join
+}
+
+// Value of the join field, nil when the record doesn't take part in relations.
+// Child is joined only when it has a parent, child types can have parentless records.
+func (this joinField) value(record esreindexer.FetchedRecord) interface{} {
+	parent := record.GetParent()
+
+	if parent != nil && this.children[record.GetType()] {
+		return map[string]string{
+			"name":   record.GetType(),
+			"parent": strconv.FormatUint(*parent, 10),
+		}
+	}
+
+	if this.parents[record.GetType()] {
+		return record.GetType()
+	}
+
+	return nil
+}
+
+// Format of the configured version, of the cluster itself when it isn't configured.
+// Client is nil in dry run, then typed format is used unless the version is configured.
+func newDocumentFormat(ctx context.Context, client *elastic.Client, configuration esreindexer.ElasticSearchConfig) (documentFormat, error) {
+	format := documentFormat{
+		typeField: configuration.TypeField,
+		joins:     map[string]joinField{},
+	}
+
+	if format.typeField == "" {
+		format.typeField = defaultTypeField
+	}
+
+	for index, indexConfig := range configuration.Indices {
+		if indexConfig.JoinField != "" {
+			format.joins[index] = newJoinField(indexConfig.JoinField, indexConfig.Relations)
+		}
+	}
+
+	var (
+		version clusterVersion
+		err     error
+	)
+
+	if configuration.Version != "" {
+		version, err = parseClusterVersion(configuration.Version)
+	} else if client != nil {
+		version, err = detectClusterVersion(ctx, client)
+	} else {
+		return format, nil
+	}
+
+	if err != nil {
+		return format, fmt.Errorf("cannot detect version of Elasticsearch: %s", err)
+	}
+
+	format.typeless = version.Typeless()
+
+	loggerFromContext(ctx).WithFields(logrus.Fields{
+		"component": "es",
+		"version":   version.String(),
+		"typeless":  format.typeless,
+	}).Info("Cluster version")
+
+	return format, nil
+}
+
+// Source of typeless document: record type goes into the type field and relation into the join field.
+// Fields are spliced into the encoded JSON object, source is decoded only when it already has one of them.
+// Data which isn't a JSON object is returned as is, bulk request reports it.
+func (this documentFormat) document(record esreindexer.FetchedRecord) interface{} {
+	data := record.GetSearchData()
+	if !this.typeless {
+		return data
+	}
+
+	var source []byte
+
+	if raw, ok := data.(json.RawMessage); ok {
+		source = raw
+	} else {
+		encoded, err := json.Marshal(data)
+		if err != nil {
+			return data
+		}
+
+		source = encoded
+	}
+
+	source = bytes.TrimSpace(source)
+	if len(source) < 2 || source[0] != '{' || source[len(source)-1] != '}' {
+		return data
+	}
+
+	fields := []string{this.typeField}
+	values := []interface{}{record.GetType()}
+
+	if join, ok := this.joins[record.GetIndex()]; ok {
+		if value := join.value(record); value != nil {
+			fields = append(fields, join.name)
+			values = append(values, value)
+		}
+	}
+
+	for _, field := range fields {
+		key, _ := json.Marshal(field)
+		if bytes.Contains(source, key) {
+			return this.decodedDocument(source, fields, values, data)
+		}
+	}
+
+	document := bytes.NewBufferString("{")
+
+	for i, field := range fields {
+		key, _ := json.Marshal(field)
+		value, err := json.Marshal(values[i])
+		if err != nil {
+			return data
+		}
+
+		if i > 0 {
+			document.WriteByte(',')
+		}
+
+		document.Write(key)
+		document.WriteByte(':')
+		document.Write(value)
+	}
+
+	rest := bytes.TrimSpace(source[1 : len(source)-1])
+	if len(rest) > 0 {
+		document.WriteByte(',')
+		document.Write(rest)
+	}
+
+	document.WriteByte('}')
+
+	return json.RawMessage(document.Bytes())
+}
+
+// Slow path of document for source which may already have the type field or the join field,
+// duplicate keys are rejected by Elasticsearch
+func (this documentFormat) decodedDocument(source []byte, fields []string, values []interface{}, data interface{}) interface{} {
+	document := map[string]interface{}{}
+
+	// Numbers are kept as is, ids don't fit float64
+	decoder := json.NewDecoder(bytes.NewReader(source))
+	decoder.UseNumber()
+
+	err := decoder.Decode(&document)
+	if err != nil {
+		return data
+	}
+
+	for i, field := range fields {
+		document[field] = values[i]
+	}
+
+	return document
+}
+
+// Child documents of join field must be routed to the shard of their parent
+func (this documentFormat) routing(record esreindexer.FetchedRecord) string {
+	join, ok := this.joins[record.GetIndex()]
+	if !ok || !join.children[record.GetType()] {
+		return ""
+	}
+
+	parent := record.GetParent()
+	if parent == nil {
+		return ""
+	}
+
+	return strconv.FormatUint(*parent, 10)
+}
+
+// Mapping of the file in format of the cluster. Types of typed file are merged for typeless cluster:
+// their properties are joined, meta fields like _all and _parent are dropped, and the type field and the join field
+// are added. Typeless file is returned as is, it must describe both fields itself.
+func (this documentFormat) mapping(alias string, mapping map[string]interface{}) map[string]interface{} {
+	if !this.typeless {
+		return mapping
+	}
+
+	if _, ok := mapping["properties"]; ok {
+		return mapping
+	}
+
+	types := make([]string, 0, len(mapping))
+	for typ := range mapping {
+		types = append(types, typ)
+	}
+
+	sort.Strings(types)
+
+	var (
+		result     = map[string]interface{}{}
+		properties = map[string]interface{}{}
+
+		templates     []interface{}
+		templateNames = map[string]bool{}
+	)
+
+	// The first type wins when types describe the same field differently
+	for _, typ := range types {
+		typeMapping, ok := mapping[typ].(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		for key, value := range typeMapping {
+			switch {
+			case strings.HasPrefix(key, "_"):
+				continue
+			case key == "properties":
+				fields, _ := value.(map[string]interface{})
+				for name, field := range fields {
+					if _, ok := properties[name]; !ok {
+						properties[name] = field
+					}
+				}
+			case key == "dynamic_templates":
+				list, _ := value.([]interface{})
+				for _, template := range list {
+					named, _ := template.(map[string]interface{})
+					for name := range named {
+						if !templateNames[name] {
+							templateNames[name] = true
+							templates = append(templates, template)
+						}
+					}
+				}
+			default:
+				if _, ok := result[key]; !ok {
+					result[key] = value
+				}
+			}
+		}
+	}
+
+	if len(templates) > 0 {
+		result["dynamic_templates"] = templates
+	}
+
+	properties[this.typeField] = map[string]interface{}{"type": "keyword"}
+
+	if join, ok := this.joins[alias]; ok {
+		// Elasticsearch returns the only child as a string, so the mapping check compares the same values
+		relations := map[string]interface{}{}
+		for parent, children := range join.relations {
+			if len(children) == 1 {
+				relations[parent] = children[0]
+			} else {
+				relations[parent] = children
+			}
+		}
+
+		properties[join.name] = map[string]interface{}{
+			"type":      "join",
+			"relations": relations,
+		}
+	}
+
+	result["properties"] = properties
+
+	return result
+}
@@ -0,0 +1,227 @@
+// Copyright 2016-present InterPals. All Rights Reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"testing"
+
+	esreindexer "github.com/interpals/es-reindexer"
+)
+
+func TestParseClusterVersion(t *testing.T) {
+	tests := []struct {
+		version  string
+		expected clusterVersion
+		typeless bool
+	}{
+		{"6.8.0", clusterVersion{Number: "6.8.0", Major: 6}, false},
+		{"7.10.2", clusterVersion{Number: "7.10.2", Major: 7}, true},
+		{"Elasticsearch 8.1.0", clusterVersion{Number: "8.1.0", Major: 8}, true},
+		{"opensearch 1.3.0", clusterVersion{Distribution: "opensearch", Number: "1.3.0", Major: 1}, true},
+	}
+
+	for _, test := range tests {
+		version, err := parseClusterVersion(test.version)
+		if err != nil {
+			t.Errorf("%s: %s", test.version, err)
+			continue
+		}
+
+		if version != test.expected {
+			t.Errorf("%s: expected %+v, got %+v", test.version, test.expected, version)
+		}
+
+		if version.Typeless() != test.typeless {
+			t.Errorf("%s: expected typeless %t", test.version, test.typeless)
+		}
+	}
+
+	for _, version := range []string{"", "seven", "opensearch", "a b c"} {
+		_, err := parseClusterVersion(version)
+		if err == nil {
+			t.Errorf("%q: expected error", version)
+		}
+	}
+}
+
+func newGeoFormat(typeless bool) documentFormat {
+	return documentFormat{
+		typeless:  typeless,
+		typeField: defaultTypeField,
+		joins: map[string]joinField{
+			"geo": newJoinField("relation", map[string][]string{"region": {"city"}}),
+		},
+	}
+}
+
+func newGeoRecord(typ string, id uint64, parent *uint64) esreindexer.RawRecord {
+	return esreindexer.RawRecord{
+		Index:  "geo",
+		Type:   typ,
+		Id:     id,
+		Parent: parent,
+		Source: json.RawMessage(`{"id":` + strconv.FormatUint(id, 10) + `}`),
+	}
+}
+
+func TestDocument(t *testing.T) {
+	regionId := uint64(1)
+
+	tests := []struct {
+		name     string
+		record   esreindexer.FetchedRecord
+		expected string
+		routing  string
+	}{
+		{
+			"parent",
+			newGeoRecord("region", 1, nil),
+			`{"doc_type":"region","relation":"region","id":1}`,
+			"",
+		},
+		{
+			"child with parent",
+			newGeoRecord("city", 2, &regionId),
+			`{"doc_type":"city","relation":{"name":"city","parent":"1"},"id":2}`,
+			"1",
+		},
+		{
+			"child without parent",
+			newGeoRecord("city", 3, nil),
+			`{"doc_type":"city","id":3}`,
+			"",
+		},
+		{
+			"type without relations",
+			newGeoRecord("country", 4, nil),
+			`{"doc_type":"country","id":4}`,
+			"",
+		},
+		{
+			"index without join field",
+			esreindexer.RawRecord{Index: "users", Type: "users", Id: 5, Source: json.RawMessage(`{"id":5}`)},
+			`{"doc_type":"users","id":5}`,
+			"",
+		},
+		{
+			"empty source",
+			esreindexer.RawRecord{Index: "users", Type: "users", Id: 6, Source: json.RawMessage(` { } `)},
+			`{"doc_type":"users"}`,
+			"",
+		},
+		{
+			"source with type field",
+			esreindexer.RawRecord{Index: "users", Type: "users", Id: 7, Source: json.RawMessage(`{"doc_type":"old","id":7}`)},
+			`{"doc_type":"users","id":7}`,
+			"",
+		},
+		{
+			"not encoded source",
+			esreindexer.User{Id: 8},
+			"",
+			"",
+		},
+	}
+
+	format := newGeoFormat(true)
+
+	for _, test := range tests {
+		document := format.document(test.record)
+
+		if test.expected == "" {
+			if _, ok := document.(json.RawMessage); !ok {
+				t.Errorf("%s: expected spliced source, got %T", test.name, document)
+			}
+		} else if encoded, err := json.Marshal(document); err != nil || string(encoded) != test.expected {
+			t.Errorf("%s: expected %s, got %s (%v)", test.name, test.expected, encoded, err)
+		}
+
+		if routing := format.routing(test.record); routing != test.routing {
+			t.Errorf("%s: expected routing %q, got %q", test.name, test.routing, routing)
+		}
+	}
+
+	// Typed cluster gets the source as is
+	record := newGeoRecord("city", 2, &regionId)
+	if document := newGeoFormat(false).document(record); !reflect.DeepEqual(document, record.Source) {
+		t.Errorf("typed document must not be changed, got %v", document)
+	}
+}
+
+func TestTypelessMapping(t *testing.T) {
+	var typed map[string]interface{}
+
+	err := json.Unmarshal([]byte(`{
+		"region": {
+			"_all": {"enabled": false},
+			"dynamic_templates": [{"strings": {"match_mapping_type": "string"}}],
+			"properties": {"name": {"type": "text"}, "code": {"type": "keyword"}}
+		},
+		"city": {
+			"_parent": {"type": "region"},
+			"dynamic": "strict",
+			"dynamic_templates": [{"strings": {"match_mapping_type": "string"}}],
+			"properties": {"name": {"type": "text"}, "population": {"type": "long"}}
+		}
+	}`), &typed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var expected map[string]interface{}
+
+	err = json.Unmarshal([]byte(`{
+		"dynamic": "strict",
+		"dynamic_templates": [{"strings": {"match_mapping_type": "string"}}],
+		"properties": {
+			"name": {"type": "text"},
+			"code": {"type": "keyword"},
+			"population": {"type": "long"},
+			"doc_type": {"type": "keyword"},
+			"relation": {"type": "join", "relations": {"region": "city"}}
+		}
+	}`), &expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mapping := newGeoFormat(true).mapping("geo", typed)
+
+	// Values are compared as JSON, so string slices and decoded arrays are equal
+	if differences := diffMapping("geo", expected, normalizeJSON(t, mapping)); len(differences) > 0 {
+		t.Errorf("unexpected mapping: %v", differences)
+	}
+
+	if differences := diffMapping("geo", normalizeJSON(t, mapping), expected); len(differences) > 0 {
+		t.Errorf("unexpected mapping: %v", differences)
+	}
+
+	if typedMapping := newGeoFormat(false).mapping("geo", typed); !reflect.DeepEqual(typedMapping, typed) {
+		t.Errorf("typed cluster must get the file as is")
+	}
+
+	// Typeless file is used as is
+	typeless := map[string]interface{}{"properties": map[string]interface{}{}}
+	if mapping := newGeoFormat(true).mapping("geo", typeless); !reflect.DeepEqual(mapping, typeless) {
+		t.Errorf("typeless file must not be changed, got %v", mapping)
+	}
+}
+
+func normalizeJSON(t *testing.T, value interface{}) map[string]interface{} {
+	content, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var result map[string]interface{}
+
+	err = json.Unmarshal(content, &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return result
+}
@@ -0,0 +1,355 @@
+// Copyright 2016-present InterPals. All Rights Reserved.
+
+package esreindexer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ghodss/yaml"
+)
+
+// Prefix of environment variables which override values of the config file
+const envPrefix = "ESREINDEXER_"
+
+// Reads JSON or YAML (by .yaml/.yml extension) config file, applies environment overrides and validates the result
+func (this *Configuration) Init(configFile string) error {
+	content, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return err
+	}
+
+	extension := strings.ToLower(filepath.Ext(configFile))
+	if extension == ".yaml" || extension == ".yml" {
+		content, err = yaml.YAMLToJSON(content)
+		if err != nil {
+			return fmt.Errorf("cannot parse %s: %s", configFile, err)
+		}
+	}
+
+	err = json.Unmarshal(content, this)
+	if err != nil {
+		return fmt.Errorf("cannot parse %s: %s", configFile, err)
+	}
+
+	err = this.applyEnv(os.Environ())
+	if err != nil {
+		return err
+	}
+
+	return this.Validate()
+}
+
+// Name of config key in environment variable, dashes and dots become underscores
+func envName(key string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(key))
+}
+
+// Setters of scalar and string list settings by name of their environment variable, names are paths of config keys,
+// for example db.uri-geo is ESREINDEXER_DB_URI_GEO and elasticsearch.clusters.backup.api-key is
+// ESREINDEXER_ELASTICSEARCH_CLUSTERS_BACKUP_API_KEY. Only keys of maps which exist in the config file can be set.
+// Values of maps aren't addressable, so they are changed in a copy which is stored back by written.
+func envFields(value reflect.Value, prefix string, fields map[string]func(string) error, written func()) {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		tag := strings.Split(value.Type().Field(i).Tag.Get("json"), ",")[0]
+
+		// Fields of embedded struct are fields of the parent in JSON
+		if tag == "" && value.Type().Field(i).Anonymous && field.Kind() == reflect.Struct {
+			envFields(field, prefix, fields, written)
+			continue
+		}
+
+		if tag == "" || tag == "-" {
+			continue
+		}
+
+		name := prefix + envName(tag)
+
+		switch field.Kind() {
+		case reflect.Struct:
+			envFields(field, name+"_", fields, written)
+		case reflect.Map:
+			if field.Type().Key().Kind() != reflect.String || field.Type().Elem().Kind() != reflect.Struct {
+				continue
+			}
+
+			for _, key := range field.MapKeys() {
+				item := reflect.New(field.Type().Elem()).Elem()
+				item.Set(field.MapIndex(key))
+
+				mapField, mapKey := field, key
+				envFields(item, name+"_"+envName(key.String())+"_", fields, func() {
+					mapField.SetMapIndex(mapKey, item)
+
+					if written != nil {
+						written()
+					}
+				})
+			}
+		case reflect.Slice:
+			if field.Type().Elem().Kind() == reflect.String {
+				fields[name] = envSetter(field, written)
+			}
+		case reflect.String, reflect.Bool, reflect.Float64,
+			reflect.Int, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			fields[name] = envSetter(field, written)
+		}
+	}
+}
+
+func envSetter(field reflect.Value, written func()) func(string) error {
+	return func(value string) error {
+		err := setEnvField(field, value)
+		if err != nil {
+			return err
+		}
+
+		if written != nil {
+			written()
+		}
+
+		return nil
+	}
+}
+
+func setEnvField(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Slice:
+		// Comma separated list
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			item = strings.TrimSpace(item)
+			if item != "" {
+				items = append(items, item)
+			}
+		}
+
+		field.Set(reflect.ValueOf(items))
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+
+		field.SetBool(parsed)
+	case reflect.Float64:
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+
+		field.SetFloat(parsed)
+	case reflect.Int:
+		parsed, err := strconv.ParseInt(value, 10, 0)
+		if err != nil {
+			return err
+		}
+
+		field.SetInt(parsed)
+	default:
+		parsed, err := strconv.ParseUint(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+
+		field.SetUint(parsed)
+	}
+
+	return nil
+}
+
+// Overrides settings by ESREINDEXER_* variables, so secrets like DSN passwords can stay out of the file.
+// Unknown variable is most likely a typo, it's added to warnings, because the environment can be shared with other tools.
+func (this *Configuration) applyEnv(environ []string) error {
+	fields := map[string]func(string) error{}
+	envFields(reflect.ValueOf(this).Elem(), envPrefix, fields, nil)
+
+	for _, variable := range environ {
+		if !strings.HasPrefix(variable, envPrefix) {
+			continue
+		}
+
+		parts := strings.SplitN(variable, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		set, ok := fields[parts[0]]
+		if !ok {
+			this.Warnings = append(this.Warnings, fmt.Sprintf("unknown environment variable %s", parts[0]))
+			continue
+		}
+
+		err := set(parts[1])
+		if err != nil {
+			return fmt.Errorf("invalid %s: %s", parts[0], err)
+		}
+	}
+
+	return nil
+}
+
+func validateRetry(name string, retry RetryConfig) []string {
+	var problems []string
+
+	if retry.Jitter < 0 || retry.Jitter > 1 {
+		problems = append(problems, name+".jitter must be from 0 to 1")
+	}
+
+	if retry.MaxDelay > 0 && retry.BaseDelay > retry.MaxDelay {
+		problems = append(problems, name+".base-delay must not be greater than max-delay")
+	}
+
+	return problems
+}
+
+func validateCluster(name string, cluster ClusterConfig) []string {
+	var problems []string
+
+	if cluster.ApiKey != "" && (cluster.Username != "" || cluster.Password != "") {
+		problems = append(problems, name+".api-key and username/password must not be used together")
+	}
+
+	if (cluster.CertFile == "") != (cluster.KeyFile == "") {
+		problems = append(problems, name+".cert-file and key-file must be set together")
+	}
+
+	return problems
+}
+
+func oneOf(value string, allowed ...string) bool {
+	for _, item := range allowed {
+		if value == item {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Checks required settings and ranges, all problems are reported at once
+func (this Configuration) Validate() error {
+	var problems []string
+
+	es := this.ElasticSearch
+
+	problems = append(problems, validateCluster("elasticsearch", es.ClusterConfig)...)
+
+	clusters := make([]string, 0, len(es.Clusters))
+	for name := range es.Clusters {
+		clusters = append(clusters, name)
+	}
+
+	sort.Strings(clusters)
+
+	for _, name := range clusters {
+		problems = append(problems, validateCluster("elasticsearch.clusters."+name, es.Clusters[name])...)
+	}
+
+	if es.Threads == 0 {
+		problems = append(problems, "elasticsearch.threads must be greater than 0")
+	}
+
+	if es.Limit == 0 {
+		problems = append(problems, "elasticsearch.limit must be greater than 0")
+	}
+
+	if es.MinLimit > es.Limit {
+		problems = append(problems, "elasticsearch.min-limit must not be greater than limit")
+	}
+
+	indices := make([]string, 0, len(es.Indices))
+	for name := range es.Indices {
+		indices = append(indices, name)
+	}
+
+	sort.Strings(indices)
+
+	for _, name := range indices {
+		if es.Indices[name].JoinField != "" && len(es.Indices[name].Relations) == 0 {
+			problems = append(problems, "elasticsearch.indices."+name+".relations are required by join-field")
+		}
+	}
+
+	if !oneOf(es.MappingCheck, "", "warn", "abort", "off") {
+		problems = append(problems, fmt.Sprintf("elasticsearch.mapping-check must be warn, abort or off, got %q", es.MappingCheck))
+	}
+
+	problems = append(problems, validateRetry("elasticsearch.retry", es.Retry)...)
+
+	db := this.DataBase
+
+	if !oneOf(db.Dialect, "mysql", "postgres") {
+		problems = append(problems, fmt.Sprintf("db.dialect must be mysql or postgres, got %q", db.Dialect))
+	}
+
+	empty := true
+	for _, uri := range db.GetUris() {
+		empty = empty && uri == ""
+	}
+
+	if empty {
+		problems = append(problems, "db.uri, db.uri-geo or db.uris is required")
+	}
+
+	if db.Threads == 0 {
+		problems = append(problems, "db.threads must be greater than 0")
+	}
+
+	if db.Limit == 0 {
+		problems = append(problems, "db.limit must be greater than 0")
+	}
+
+	if db.MaxIdleConnections < 0 || db.MaxOpenConnections < 0 {
+		problems = append(problems, "db.max-idle-connections and db.max-open-connections must not be negative")
+	}
+
+	problems = append(problems, validateRetry("db.retry", db.Retry)...)
+
+	models := make([]string, 0, len(db.Throttle))
+	for model := range db.Throttle {
+		models = append(models, model)
+	}
+
+	sort.Strings(models)
+
+	for _, model := range models {
+		if db.Throttle[model].DefaultFactor < 0 {
+			problems = append(problems, "db.throttle."+model+".default-factor must not be negative")
+		}
+	}
+
+	if !oneOf(db.Binlog.Flavor, "", "mysql", "mariadb") {
+		problems = append(problems, fmt.Sprintf("db.binlog.flavor must be mysql or mariadb, got %q", db.Binlog.Flavor))
+	}
+
+	if this.ChannelBufferSize < 0 {
+		problems = append(problems, "channel-buffer-size must not be negative")
+	}
+
+	if !oneOf(this.Log.Level, "", "debug", "info", "warn", "warning", "error") {
+		problems = append(problems, fmt.Sprintf("log.level must be debug, info, warn or error, got %q", this.Log.Level))
+	}
+
+	if !oneOf(this.Log.Format, "", "text", "json") {
+		problems = append(problems, fmt.Sprintf("log.format must be text or json, got %q", this.Log.Format))
+	}
+
+	problems = append(problems, validateRetry("daemon.retry", this.Daemon.Retry)...)
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+
+	return nil
+}
@@ -0,0 +1,207 @@
+// Copyright 2016-present InterPals. All Rights Reserved.
+
+package esreindexer
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func validConfiguration() Configuration {
+	return Configuration{
+		ElasticSearch: ElasticSearchConfig{
+			ClusterConfig: ClusterConfig{Urls: []string{"http://127.0.0.1:9200"}},
+			Clusters: map[string]ClusterConfig{
+				"backup": {Urls: []string{"http://backup:9200"}, Username: "elastic"},
+			},
+			Limit:   1000,
+			Threads: 2,
+		},
+		DataBase: DataBaseConfig{
+			Dialect: "mysql",
+			Uri:     "root@/penpals",
+			Threads: 2,
+			Limit:   1000,
+			Throttle: map[string]ThrottleConfig{
+				"users": {RowsPerSecond: 100},
+			},
+		},
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	config := validConfiguration()
+
+	err := config.applyEnv([]string{
+		"PATH=/bin",
+		"ESREINDEXER_DB_URI=user:secret@/penpals",
+		"ESREINDEXER_DB_THREADS=8",
+		"ESREINDEXER_ELASTICSEARCH_URLS=http://a:9200, http://b:9200,",
+		"ESREINDEXER_ELASTICSEARCH_SNIFF=true",
+		"ESREINDEXER_ELASTICSEARCH_CLUSTERS_BACKUP_PASSWORD=secret",
+		"ESREINDEXER_ELASTICSEARCH_CLUSTERS_BACKUP_TIMEOUT=5000",
+		"ESREINDEXER_DB_THROTTLE_USERS_DEFAULT_FACTOR=0.5",
+		"ESREINDEXER_ELASTICSEARCH_CLUSTERS_OTHER_PASSWORD=secret",
+		"ESREINDEXER_DB_UNKNOWN=1",
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.DataBase.Uri != "user:secret@/penpals" || config.DataBase.Threads != 8 {
+		t.Errorf("db settings aren't overridden: %+v", config.DataBase)
+	}
+
+	if !reflect.DeepEqual(config.ElasticSearch.Urls, []string{"http://a:9200", "http://b:9200"}) {
+		t.Errorf("unexpected urls %v", config.ElasticSearch.Urls)
+	}
+
+	if !config.ElasticSearch.Sniff {
+		t.Errorf("sniff isn't overridden")
+	}
+
+	backup := config.ElasticSearch.Clusters["backup"]
+	if backup.Password != "secret" || backup.Timeout != 5000 || backup.Username != "elastic" {
+		t.Errorf("cluster settings aren't overridden or lost: %+v", backup)
+	}
+
+	if config.DataBase.Throttle["users"].DefaultFactor != 0.5 || config.DataBase.Throttle["users"].RowsPerSecond != 100 {
+		t.Errorf("throttle settings aren't overridden or lost: %+v", config.DataBase.Throttle["users"])
+	}
+
+	// Map entries which aren't in the file aren't created
+	if _, ok := config.ElasticSearch.Clusters["other"]; ok {
+		t.Errorf("unknown cluster is created")
+	}
+
+	if len(config.Warnings) != 2 ||
+		!strings.Contains(config.Warnings[0], "ESREINDEXER_ELASTICSEARCH_CLUSTERS_OTHER_PASSWORD") ||
+		!strings.Contains(config.Warnings[1], "ESREINDEXER_DB_UNKNOWN") {
+		t.Errorf("unexpected warnings %v", config.Warnings)
+	}
+}
+
+func TestApplyEnvInvalidValue(t *testing.T) {
+	config := validConfiguration()
+
+	err := config.applyEnv([]string{"ESREINDEXER_DB_THREADS=many"})
+	if err == nil || !strings.Contains(err.Error(), "ESREINDEXER_DB_THREADS") {
+		t.Errorf("expected error of ESREINDEXER_DB_THREADS, got %v", err)
+	}
+
+	err = config.applyEnv([]string{"ESREINDEXER_ELASTICSEARCH_THREADS=256"})
+	if err == nil {
+		t.Errorf("expected error of value out of uint8 range")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		change   func(config *Configuration)
+		problems []string
+	}{
+		{"valid", func(config *Configuration) {}, nil},
+		{
+			// Dry run doesn't need Elasticsearch
+			"without urls",
+			func(config *Configuration) {
+				config.ElasticSearch.Urls = nil
+			},
+			nil,
+		},
+		{
+			"invalid values",
+			func(config *Configuration) {
+				config.ElasticSearch.Threads = 0
+				config.ElasticSearch.MinLimit = 2000
+				config.DataBase.Dialect = "sqlite"
+				config.DataBase.Uri = ""
+				config.Log.Level = "trace"
+			},
+			[]string{
+				"elasticsearch.threads must be greater than 0",
+				"elasticsearch.min-limit must not be greater than limit",
+				`db.dialect must be mysql or postgres, got "sqlite"`,
+				"db.uri, db.uri-geo or db.uris is required",
+				`log.level must be debug, info, warn or error, got "trace"`,
+			},
+		},
+		{
+			"cluster credentials",
+			func(config *Configuration) {
+				backup := config.ElasticSearch.Clusters["backup"]
+				backup.ApiKey = "id:key"
+				backup.CertFile = "client.pem"
+				config.ElasticSearch.Clusters["backup"] = backup
+			},
+			[]string{
+				"elasticsearch.clusters.backup.api-key and username/password must not be used together",
+				"elasticsearch.clusters.backup.cert-file and key-file must be set together",
+			},
+		},
+		{
+			"join field without relations",
+			func(config *Configuration) {
+				config.ElasticSearch.Indices = map[string]IndexConfig{"geo": {JoinField: "relation"}}
+			},
+			[]string{"elasticsearch.indices.geo.relations are required by join-field"},
+		},
+		{
+			"retry",
+			func(config *Configuration) {
+				config.DataBase.Retry = RetryConfig{BaseDelay: 1000, MaxDelay: 100, Jitter: 2}
+			},
+			[]string{
+				"db.retry.jitter must be from 0 to 1",
+				"db.retry.base-delay must not be greater than max-delay",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		config := validConfiguration()
+		test.change(&config)
+
+		err := config.Validate()
+
+		if test.problems == nil {
+			if err != nil {
+				t.Errorf("%s: unexpected error %s", test.name, err)
+			}
+
+			continue
+		}
+
+		if err == nil {
+			t.Errorf("%s: expected error", test.name)
+			continue
+		}
+
+		for _, problem := range test.problems {
+			if !strings.Contains(err.Error(), problem) {
+				t.Errorf("%s: %q isn't reported in %s", test.name, problem, err)
+			}
+		}
+	}
+}
+
+func TestGetUri(t *testing.T) {
+	db := DataBaseConfig{
+		Uri:  "root@/penpals",
+		Uris: map[string]string{"uri-geo": "root@/geo", "uri-places": "root@/places", "uri": "root@/old"},
+	}
+
+	for key, expected := range map[string]string{
+		"uri":        "root@/penpals",
+		"uri-geo":    "root@/geo",
+		"uri-places": "root@/places",
+		"uri-other":  "",
+	} {
+		if uri := db.GetUri(key); uri != expected {
+			t.Errorf("%s: expected %q, got %q", key, expected, uri)
+		}
+	}
+}
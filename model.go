@@ -3,10 +3,6 @@
 package esreindexer
 
 import (
-	"encoding/json"
-	"fmt"
-	"io/ioutil"
-	"os"
 	"runtime"
 	"sync/atomic"
 )
@@ -29,41 +25,248 @@ type Location struct {
 	Lon float32 `json:"lon"`
 }
 
+// Retry policy with exponential backoff, zero values mean defaults
+type RetryConfig struct {
+	Attempts uint8 `json:"attempts"`
+
+	// In milliseconds
+	BaseDelay uint32 `json:"base-delay"`
+	MaxDelay  uint32 `json:"max-delay"`
+
+	// Random part of the delay, 0.2 means +-20%
+	Jitter float64 `json:"jitter"`
+}
+
+// Files with index mapping and settings in Elasticsearch format
+type IndexConfig struct {
+	Mapping  string `json:"mapping"`
+	Settings string `json:"settings"`
+
+	// Join field of typeless index, parent and child records are joined by it instead of _parent
+	JoinField string `json:"join-field"`
+
+	// Child types by parent type of the join field, records of other types don't get the join field
+	Relations map[string][]string `json:"relations"`
+}
+
+// Connection to Elasticsearch cluster
+type ClusterConfig struct {
+	// Nodes or load balancer, uri is the single node of old configs
+	Urls []string `json:"urls"`
+	Uri  string   `json:"uri"`
+
+	// Sniffing finds other nodes of the cluster, it must be off behind load balancer
+	Sniff       bool `json:"sniff"`
+	Healthcheck bool `json:"healthcheck"`
+
+	// Basic auth or API key ("id:key" or already encoded), not both
+	Username string `json:"username"`
+	Password string `json:"password"`
+	ApiKey   string `json:"api-key"`
+
+	// PEM files of custom CA and of client certificate
+	CaFile             string `json:"ca-file"`
+	CertFile           string `json:"cert-file"`
+	KeyFile            string `json:"key-file"`
+	InsecureSkipVerify bool   `json:"insecure-skip-verify"`
+
+	// Timeout of a request in milliseconds, 0 means no timeout
+	Timeout uint32 `json:"timeout"`
+}
+
+// Node URLs of the cluster
+func (this ClusterConfig) GetUrls() []string {
+	if len(this.Urls) > 0 {
+		return this.Urls
+	}
+
+	if this.Uri != "" {
+		return []string{this.Uri}
+	}
+
+	return nil
+}
+
 type ElasticSearchConfig struct {
-	Uri     string `json:"uri"`
-	Limit   uint16 `json:"limit"`
-	Threads uint8  `json:"threads"`
+	ClusterConfig
+
+	// Other clusters by name, -cluster uses one of them instead of the connection above
+	Clusters map[string]ClusterConfig `json:"clusters"`
+
+	Limit   uint16      `json:"limit"`
+	Threads uint8       `json:"threads"`
+	Retry   RetryConfig `json:"retry"`
+
+	// Bulk is sent when it reaches limit of documents or bytes, the limit of documents
+	// is adjusted between min-limit and limit by latency of bulks and rejections
+	MinLimit      uint16 `json:"min-limit"`
+	MaxBulkBytes  uint32 `json:"max-bulk-bytes"`
+	TargetLatency uint32 `json:"target-latency"` // In milliseconds
+
+	// Bulk which isn't full is sent after this interval in milliseconds
+	FlushInterval uint32 `json:"flush-interval"`
+
+	// How many previous generations of rebuilt index are kept
+	IndexRetention uint8 `json:"index-retention"`
+
+	// By index or alias name
+	Indices map[string]IndexConfig `json:"indices"`
+
+	// What to do when live mapping differs from the file: warn, abort or off
+	MappingCheck string `json:"mapping-check"`
+
+	// Version of the cluster like "6.8.0" or "opensearch 2.11.0", it's detected when empty.
+	// Dry run has no connection, it writes typeless bodies only with version 7 or later.
+	Version string `json:"version"`
+
+	// Document field with record type in typeless indices, "doc_type" by default
+	TypeField string `json:"type-field"`
+}
+
+// Part of configured rates which is used in time of day window, "from" and "to" are local "HH:MM"
+type ThrottleWindow struct {
+	From   string  `json:"from"`
+	To     string  `json:"to"`
+	Factor float64 `json:"factor"`
+}
+
+// Limits of all fetch threads of a model together, 0 means unlimited
+type ThrottleConfig struct {
+	RowsPerSecond    uint32 `json:"rows-per-second"`
+	QueriesPerSecond uint32 `json:"queries-per-second"`
+
+	// Part of the rates outside of schedule windows, 1 by default
+	DefaultFactor float64          `json:"default-factor"`
+	Schedule      []ThrottleWindow `json:"schedule"`
+}
+
+// Replication client of "<model>-stream" commands, it connects with credentials of db.uri
+type BinlogConfig struct {
+	// Must be unique between replicas of the server
+	ServerId uint32 `json:"server-id"`
+	Flavor   string `json:"flavor"` // mysql or mariadb
+
+	// Column with user id by table name
+	Tables map[string]string `json:"tables"`
+
+	// Changed records are fetched when batch-size ids are collected or batch-interval (ms) passed
+	BatchSize     uint16 `json:"batch-size"`
+	BatchInterval uint32 `json:"batch-interval"`
 }
 
 type DataBaseConfig struct {
-	Dialect            string `json:"dialect"`
-	Uri                string `json:"uri"`
-	UriGeo             string `json:"uri-geo"`
-	MaxIdleConnections int    `json:"max-idle-connections"`
-	MaxOpenConnections int    `json:"max-open-connections"`
-	ShowLog            bool   `json:"log"`
-	Threads            uint8  `json:"threads"`
-	Limit              uint16 `json:"limit"`
+	Dialect            string      `json:"dialect"`
+	Uri                string      `json:"uri"`
+	UriGeo             string      `json:"uri-geo"`
+	MaxIdleConnections int         `json:"max-idle-connections"`
+	MaxOpenConnections int         `json:"max-open-connections"`
+	ShowLog            bool        `json:"log"`
+	Threads            uint8       `json:"threads"`
+	Limit              uint16      `json:"limit"`
+	Retry              RetryConfig `json:"retry"`
+
+	// DSNs of other sources by their key
+	Uris map[string]string `json:"uris"`
+
+	// By model name
+	Throttle map[string]ThrottleConfig `json:"throttle"`
+
+	Binlog BinlogConfig `json:"binlog"`
+}
+
+// DSNs by config key: uris and uri, uri-geo of the section. They are fields, so environment can override them.
+func (this DataBaseConfig) GetUris() map[string]string {
+	uris := map[string]string{}
+	for key, uri := range this.Uris {
+		uris[key] = uri
+	}
+
+	for key, uri := range map[string]string{"uri": this.Uri, "uri-geo": this.UriGeo} {
+		if uri != "" {
+			uris[key] = uri
+		}
+	}
+
+	return uris
+}
+
+// Returns DSN by its config key, see Source.DataBaseUriKey
+func (this DataBaseConfig) GetUri(key string) string {
+	return this.GetUris()[key]
+}
+
+// Files with bulk bodies of -dry-run, a new file is started when max-file-bytes is reached
+type DryRunConfig struct {
+	Dir          string `json:"dir"`
+	MaxFileBytes uint32 `json:"max-file-bytes"`
+}
+
+type LogConfig struct {
+	// debug, info, warn or error, info by default
+	Level string `json:"level"`
+
+	// text or json, text by default
+	Format string `json:"format"`
+}
+
+// Job of daemon command, options are the same as command line ones
+type JobConfig struct {
+	Name    string `json:"name"`
+	Command string `json:"command"`
+	Field   string `json:"field"`
+	Total   uint64 `json:"total"`
+	Rebuild bool   `json:"rebuild"`
+
+	// Seconds between runs or daily local time "HH:MM", one of them is required except for stream which runs continuously
+	Interval uint32 `json:"interval"`
+	At       string `json:"at"`
+}
+
+type DaemonConfig struct {
+	Jobs []JobConfig `json:"jobs"`
+
+	// Backoff of failed jobs, attempts aren't limited
+	Retry RetryConfig `json:"retry"`
 }
 
 type Configuration struct {
 	ElasticSearch     ElasticSearchConfig `json:"elasticsearch"`
 	DataBase          DataBaseConfig      `json:"db"`
 	ChannelBufferSize int                 `json:"channel-buffer-size"`
+	DeadLetterFile    string              `json:"dead-letter-file"`
+
+	Log LogConfig `json:"log"`
+
+	// Directory for checkpoints and other state between runs
+	StateDir string `json:"state-dir"`
+
+	Daemon DaemonConfig `json:"daemon"`
+	DryRun DryRunConfig `json:"dry-run"`
+
+	// How often progress of full reindex is logged, in seconds
+	ProgressInterval uint32 `json:"progress-interval"`
+
+	// Address of HTTP server with Prometheus metrics and admin API, for example ":9102", empty disables it
+	HttpListen string `json:"http-listen"`
+
+	// Problems of the config which don't stop the process, they are logged after logging is set up
+	Warnings []string `json:"-"`
 }
 
-func (this *Configuration) Init(configFile string) {
-	configJson, err := ioutil.ReadFile(configFile)
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+func (this Configuration) GetStateDir() string {
+	if this.StateDir == "" {
+		return "."
 	}
 
-	err = json.Unmarshal(configJson, &this)
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	return this.StateDir
+}
+
+func (this Configuration) GetDeadLetterFile() string {
+	if this.DeadLetterFile == "" {
+		return "dead-letters.ndjson"
 	}
+
+	return this.DeadLetterFile
 }
 
 type FetchedRecord interface {
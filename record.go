@@ -0,0 +1,120 @@
+// Copyright 2016-present InterPals. All Rights Reserved.
+
+package esreindexer
+
+import (
+	"encoding/json"
+)
+
+// Record with already encoded search data, for example read back from a file
+type RawRecord struct {
+	FetchedRecord `json:"-"`
+
+	Index  string          `json:"index"`
+	Type   string          `json:"type"`
+	Id     uint64          `json:"id"`
+	Parent *uint64         `json:"parent,omitempty"`
+	Source json.RawMessage `json:"source,omitempty"`
+
+	// Document must be deleted, there is no source
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+func NewRawRecord(record FetchedRecord) (RawRecord, error) {
+	raw := RawRecord{
+		Index:   record.GetIndex(),
+		Type:    record.GetType(),
+		Id:      record.GetId(),
+		Parent:  record.GetParent(),
+		Deleted: IsDeleted(record),
+	}
+
+	if raw.Deleted {
+		return raw, nil
+	}
+
+	source, err := json.Marshal(record.GetSearchData())
+	if err != nil {
+		return RawRecord{}, err
+	}
+
+	raw.Source = source
+
+	return raw, nil
+}
+
+func (this RawRecord) GetIndex() string {
+	return this.Index
+}
+
+func (this RawRecord) GetType() string {
+	return this.Type
+}
+
+func (this RawRecord) GetId() uint64 {
+	return this.Id
+}
+
+func (this RawRecord) GetParent() *uint64 {
+	return this.Parent
+}
+
+func (this RawRecord) GetSearchData() interface{} {
+	return this.Source
+}
+
+func (this RawRecord) IsDeleted() bool {
+	return this.Deleted
+}
+
+// Records which implement Deletion and return true are deleted from the index instead of indexing
+type Deletion interface {
+	IsDeleted() bool
+}
+
+func IsDeleted(record FetchedRecord) bool {
+	deletion, ok := record.(Deletion)
+	return ok && deletion.IsDeleted()
+}
+
+// Document which left the index, for example user who was deactivated or hid the profile
+type DeletedRecord struct {
+	FetchedRecord `json:"-"`
+
+	Index  string
+	Type   string
+	Id     uint64
+	Parent *uint64
+}
+
+func NewDeletedRecord(index string, typ string, id uint64) DeletedRecord {
+	return DeletedRecord{
+		Index: index,
+		Type:  typ,
+		Id:    id,
+	}
+}
+
+func (this DeletedRecord) GetIndex() string {
+	return this.Index
+}
+
+func (this DeletedRecord) GetType() string {
+	return this.Type
+}
+
+func (this DeletedRecord) GetId() uint64 {
+	return this.Id
+}
+
+func (this DeletedRecord) GetParent() *uint64 {
+	return this.Parent
+}
+
+func (this DeletedRecord) GetSearchData() interface{} {
+	return nil
+}
+
+func (this DeletedRecord) IsDeleted() bool {
+	return true
+}
@@ -31,6 +31,8 @@ type User struct {
 	FetchedRecord `json:"-"`
 
 	Id            uint64 `json:"id"`
+	Activated     bool   `json:"-"`
+	Searchable    bool   `json:"-"`
 	Signup        string `json:"signup"`
 	Last_login    string `json:"last_login"`
 	Modified      string `json:"modified"`